@@ -0,0 +1,707 @@
+package main
+
+import (
+	"articache/internal/access"
+	"articache/internal/provider"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// config is articache's configuration. Every setting is a flag; a YAML file
+// given with --config uses the flag names as keys, and flags given on the
+// command line override it.
+type config struct {
+	ConfigFile string `yaml:"-"`
+
+	Addr            string `yaml:"addr"`
+	MaintenanceAddr string `yaml:"maintenance-addr"`
+	Path            string `yaml:"path"`
+	Workers         int    `yaml:"workers"`
+	LogLevel        string `yaml:"log-level"`
+	LogFormat       string `yaml:"log-format"`
+
+	TLSCert  string `yaml:"tls-cert"`
+	TLSKey   string `yaml:"tls-key"`
+	ClientCA string `yaml:"client-ca"`
+	Htpasswd string `yaml:"htpasswd"`
+	Tokens   string `yaml:"tokens"`
+	// Access and Deploy map client identities to the path prefixes they
+	// may read and upload to; only available in the file.
+	Access map[string][]string `yaml:"access"`
+	Deploy map[string][]string `yaml:"deploy"`
+	Hosted []string            `yaml:"hosted"`
+
+	// Repos is the structured form of Repo, RepoInclude and RepoExclude,
+	// only available in the file.
+	Repos       []repoConfig `yaml:"repos"`
+	Repo        []string     `yaml:"repo"`
+	RepoInclude []string     `yaml:"repo-include"`
+	RepoExclude []string     `yaml:"repo-exclude"`
+
+	MissMode        string        `yaml:"miss-mode"`
+	NegativeTTL     time.Duration `yaml:"negative-ttl"`
+	NegativePersist bool          `yaml:"negative-persist"`
+	MaxSize         string        `yaml:"max-size"`
+	EvictHigh       float64       `yaml:"evict-high-watermark"`
+	EvictLow        float64       `yaml:"evict-low-watermark"`
+	MetadataMaxAge  time.Duration `yaml:"metadata-max-age"`
+	SnapshotMaxAge  time.Duration `yaml:"snapshot-max-age"`
+	RawMaxAge       time.Duration `yaml:"raw-max-age"`
+	ChecksumPolicy  string        `yaml:"checksum-policy"`
+
+	RetryAttempts    int           `yaml:"retry-attempts"`
+	RetryBackoff     time.Duration `yaml:"retry-backoff"`
+	RetryMaxBackoff  time.Duration `yaml:"retry-max-backoff"`
+	BreakerThreshold int           `yaml:"breaker-threshold"`
+	BreakerCooldown  time.Duration `yaml:"breaker-cooldown"`
+
+	Storage          string        `yaml:"storage"`
+	S3Endpoint       string        `yaml:"s3-endpoint"`
+	S3Bucket         string        `yaml:"s3-bucket"`
+	S3Region         string        `yaml:"s3-region"`
+	S3Prefix         string        `yaml:"s3-prefix"`
+	S3PathStyle      bool          `yaml:"s3-path-style"`
+	PresignHits      time.Duration `yaml:"presign-hits"`
+	NoRedirectAgents []string      `yaml:"no-redirect-agent"`
+
+	NPMRegistry string   `yaml:"npm-registry"`
+	GoProxy     string   `yaml:"go-proxy"`
+	GoSumDB     string   `yaml:"go-sumdb"`
+	PyPIIndex   string   `yaml:"pypi-index"`
+	Raw         []string `yaml:"raw"`
+	PublicURL   string   `yaml:"public-url"`
+
+	// Mounts serve further caches below paths of their own; only available
+	// in the file.
+	Mounts []mountConfig `yaml:"mounts"`
+
+	// Credentials authenticate to upstreams, keyed by upstream name; only
+	// available in the file.
+	Credentials map[string]credentialsConfig `yaml:"credentials"`
+}
+
+// repoConfig describes one upstream repository in the config file.
+type repoConfig struct {
+	Name    string   `yaml:"name"`
+	URL     string   `yaml:"url"`
+	Include []string `yaml:"include"`
+	Exclude []string `yaml:"exclude"`
+}
+
+// mountConfig describes a cache served below its own path of the artifact
+// port, with its own upstreams and storage. Policies left unset are taken
+// from the top level.
+type mountConfig struct {
+	Path           string         `yaml:"path"`
+	Format         string         `yaml:"format"`
+	Repos          []repoConfig   `yaml:"repos"`
+	Hosted         []string       `yaml:"hosted"`
+	MissMode       string         `yaml:"miss-mode"`
+	ChecksumPolicy string         `yaml:"checksum-policy"`
+	NegativeTTL    *time.Duration `yaml:"negative-ttl"`
+	MetadataMaxAge *time.Duration `yaml:"metadata-max-age"`
+	SnapshotMaxAge *time.Duration `yaml:"snapshot-max-age"`
+	RawMaxAge      *time.Duration `yaml:"raw-max-age"`
+}
+
+// credentialsConfig describes how to authenticate to an upstream. Secrets are
+// read from files or environment variables, never from the config file
+// itself, so that they can come from mounted secrets, and re-read on every
+// reload.
+type credentialsConfig struct {
+	Username     string `yaml:"username"`
+	PasswordFile string `yaml:"password-file"`
+	PasswordEnv  string `yaml:"password-env"`
+	TokenFile    string `yaml:"token-file"`
+	TokenEnv     string `yaml:"token-env"`
+	CertFile     string `yaml:"cert-file"`
+	KeyFile      string `yaml:"key-file"`
+	CAFile       string `yaml:"ca-file"`
+}
+
+func defaultConfig() config {
+	return config{
+		Addr:             ":8080",
+		MaintenanceAddr:  ":8081",
+		Path:             "/tmp/articache_data",
+		Workers:          20,
+		LogLevel:         "info",
+		LogFormat:        "json",
+		MissMode:         "redirect",
+		NegativeTTL:      10 * time.Minute,
+		MaxSize:          "0",
+		EvictHigh:        0.95,
+		EvictLow:         0.85,
+		MetadataMaxAge:   30 * time.Minute,
+		SnapshotMaxAge:   30 * time.Minute,
+		RawMaxAge:        30 * time.Minute,
+		ChecksumPolicy:   "warn",
+		RetryAttempts:    3,
+		RetryBackoff:     200 * time.Millisecond,
+		RetryMaxBackoff:  5 * time.Second,
+		BreakerThreshold: 5,
+		BreakerCooldown:  30 * time.Second,
+		Storage:          "fs",
+		S3Endpoint:       "https://s3.amazonaws.com",
+		S3Region:         "us-east-1",
+	}
+}
+
+// flagSet returns flags that set the fields of cfg, with its current values
+// as defaults.
+func (cfg *config) flagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet("articache", flag.ContinueOnError)
+	fs.StringVar(&cfg.ConfigFile, "config", cfg.ConfigFile, "YAML configuration file whose keys are these flag names; re-read on SIGHUP or when it changes. Flags override it.")
+	fs.StringVar(&cfg.Addr, "addr", cfg.Addr, "Artifact HTTP listen address.")
+	fs.StringVar(&cfg.MaintenanceAddr, "maintenance-addr", cfg.MaintenanceAddr, "Maintenance HTTP listen address (healthz/metrics).")
+	fs.StringVar(&cfg.Path, "path", cfg.Path, "Cache path.")
+	fs.StringVar(&cfg.TLSCert, "tls-cert", cfg.TLSCert, "Certificate file to serve the artifact port over TLS with.")
+	fs.StringVar(&cfg.TLSKey, "tls-key", cfg.TLSKey, "Private key file for --tls-cert.")
+	fs.StringVar(&cfg.ClientCA, "client-ca", cfg.ClientCA, "CA file to verify client certificates against; clients are identified by their certificate's common name. Requires --tls-cert.")
+	fs.StringVar(&cfg.Htpasswd, "htpasswd", cfg.Htpasswd, "htpasswd file (bcrypt or SHA hashes) of users allowed basic auth on the artifact port.")
+	fs.StringVar(&cfg.Tokens, "tokens", cfg.Tokens, "File of identity:token lines, one per bearer token accepted on the artifact port.")
+	fs.Var(&listFlag{values: &cfg.RepoInclude}, "repo-include", "Route only paths matching a glob to a repository, as name=glob (e.g. nexus=/com/ourcompany/**); repeatable.")
+	fs.Var(&listFlag{values: &cfg.RepoExclude}, "repo-exclude", "Never resolve paths matching a glob against a repository, as name=glob; repeatable.")
+	fs.Var(&listFlag{values: &cfg.Repo}, "repo", "Remote repository as [name=]url; repeat to add fallbacks, tried in order (default https://repo.maven.apache.org/maven2).")
+	fs.Var(&listFlag{values: &cfg.Hosted}, "hosted", "Path prefix of a hosted Maven repository that accepts uploads (mvn deploy) instead of proxying, e.g. /com/ourcompany, with uploads granted by deploy rules in the config file; repeatable.")
+	fs.IntVar(&cfg.Workers, "workers", cfg.Workers, "Number of background download workers.")
+	fs.StringVar(&cfg.MissMode, "miss-mode", cfg.MissMode, "How to answer cache misses: redirect (to upstream, download in background) or proxy (stream from upstream).")
+	fs.DurationVar(&cfg.NegativeTTL, "negative-ttl", cfg.NegativeTTL, "How long upstream 404s are remembered; 0 disables negative caching.")
+	fs.BoolVar(&cfg.NegativePersist, "negative-persist", cfg.NegativePersist, "Persist the negative cache under the cache path so it survives restarts.")
+	fs.StringVar(&cfg.MaxSize, "max-size", cfg.MaxSize, "Maximum total size of cached artifacts of each format, e.g. 20Gi or 500M; 0 disables eviction.")
+	fs.Float64Var(&cfg.EvictHigh, "evict-high-watermark", cfg.EvictHigh, "Fraction of --max-size at which least recently used artifacts start being evicted.")
+	fs.Float64Var(&cfg.EvictLow, "evict-low-watermark", cfg.EvictLow, "Fraction of --max-size that eviction brings usage down to.")
+	fs.DurationVar(&cfg.MetadataMaxAge, "metadata-max-age", cfg.MetadataMaxAge, "How long cached maven-metadata.xml files are served before revalidating upstream; 0 never revalidates.")
+	fs.DurationVar(&cfg.SnapshotMaxAge, "snapshot-max-age", cfg.SnapshotMaxAge, "How long cached -SNAPSHOT artifacts are served before revalidating upstream; 0 never revalidates.")
+	fs.DurationVar(&cfg.RawMaxAge, "raw-max-age", cfg.RawMaxAge, "How long cached raw files are served before revalidating upstream when upstream sends no Cache-Control or Expires header; 0 never revalidates.")
+	fs.StringVar(&cfg.ChecksumPolicy, "checksum-policy", cfg.ChecksumPolicy, "Verify downloads against upstream .sha1/.sha256/.sha512/.md5 files: warn (verify when published), strict (require one) or off.")
+	fs.IntVar(&cfg.RetryAttempts, "retry-attempts", cfg.RetryAttempts, "How many times a download failing with a 5xx, a timeout or a dropped connection is tried; 1 disables retries.")
+	fs.DurationVar(&cfg.RetryBackoff, "retry-backoff", cfg.RetryBackoff, "Delay before the first retry of a download, doubled for each further retry and jittered.")
+	fs.DurationVar(&cfg.RetryMaxBackoff, "retry-max-backoff", cfg.RetryMaxBackoff, "Longest delay between retries of a download.")
+	fs.IntVar(&cfg.BreakerThreshold, "breaker-threshold", cfg.BreakerThreshold, "Failures in a row after which an upstream gets no requests until --breaker-cooldown has passed; 0 disables circuit breakers.")
+	fs.DurationVar(&cfg.BreakerCooldown, "breaker-cooldown", cfg.BreakerCooldown, "How long an upstream whose circuit breaker opened gets no requests before a trial request is sent to it.")
+	fs.StringVar(&cfg.Storage, "storage", cfg.Storage, "Storage backend for cached artifacts: fs (under --path) or s3.")
+	fs.StringVar(&cfg.S3Endpoint, "s3-endpoint", cfg.S3Endpoint, "S3-compatible endpoint URL, e.g. http://minio:9000.")
+	fs.StringVar(&cfg.S3Bucket, "s3-bucket", cfg.S3Bucket, "S3 bucket holding cached artifacts.")
+	fs.StringVar(&cfg.S3Region, "s3-region", cfg.S3Region, "S3 region used to sign requests.")
+	fs.StringVar(&cfg.S3Prefix, "s3-prefix", cfg.S3Prefix, "Key prefix for cached artifacts, so that several caches can share a bucket.")
+	fs.BoolVar(&cfg.S3PathStyle, "s3-path-style", cfg.S3PathStyle, "Address the bucket as a path segment instead of a virtual host (MinIO and most self-hosted services).")
+	fs.DurationVar(&cfg.PresignHits, "presign-hits", cfg.PresignHits, "Redirect cache hits to presigned object-store URLs valid this long (s3 storage only); 0 serves hits directly.")
+	fs.Var(&listFlag{values: &cfg.NoRedirectAgents}, "no-redirect-agent", "User-Agent substring of clients that do not follow redirects and are always served cache hits directly; repeatable.")
+	fs.StringVar(&cfg.GoProxy, "go-proxy", cfg.GoProxy, "Go module proxy to cache under /go/, e.g. https://proxy.golang.org; empty disables Go module support.")
+	fs.StringVar(&cfg.GoSumDB, "go-sumdb", cfg.GoSumDB, "Checksum database to verify Go module downloads against, e.g. https://sum.golang.org; empty disables verification.")
+	fs.StringVar(&cfg.PyPIIndex, "pypi-index", cfg.PyPIIndex, "Python package index to cache under /pypi/, e.g. https://pypi.org; empty disables PyPI support.")
+	fs.Var(&listFlag{values: &cfg.Raw}, "raw", "File tree to cache under /raw/<name>/, as [name=]url (e.g. gradle=https://services.gradle.org/distributions); repeatable.")
+	fs.StringVar(&cfg.NPMRegistry, "npm-registry", cfg.NPMRegistry, "npm registry to cache under /npm/, e.g. https://registry.npmjs.org; empty disables npm support.")
+	fs.StringVar(&cfg.PublicURL, "public-url", cfg.PublicURL, "URL clients reach the artifact server under, used in links handed out in package metadata (default: taken from each request).")
+	fs.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "Log level: debug, info, warn, error.")
+	fs.StringVar(&cfg.LogFormat, "log-format", cfg.LogFormat, "Log format: json or text.")
+	return fs
+}
+
+// listFlag collects the values of a repeatable flag. The first use on the
+// command line replaces what the config file set.
+type listFlag struct {
+	values *[]string
+	set    bool
+}
+
+func (l *listFlag) String() string {
+	if l.values == nil {
+		return ""
+	}
+	return strings.Join(*l.values, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	if !l.set {
+		*l.values, l.set = nil, true
+	}
+	*l.values = append(*l.values, value)
+	return nil
+}
+
+// loadConfig reads the configuration from the command line arguments and the
+// config file they name, and checks it.
+func loadConfig(args []string, output io.Writer) (settings, error) {
+	cfg := defaultConfig()
+	fs := cfg.flagSet()
+	fs.SetOutput(output)
+	if err := fs.Parse(args); err != nil {
+		return settings{}, err
+	}
+	if cfg.ConfigFile != "" {
+		file := defaultConfig()
+		if err := file.readFile(cfg.ConfigFile); err != nil {
+			return settings{}, err
+		}
+		// Parsing the arguments again applies only the flags that were
+		// given, on top of the file.
+		fs = file.flagSet()
+		fs.SetOutput(output)
+		if err := fs.Parse(args); err != nil {
+			return settings{}, err
+		}
+		cfg = file
+	}
+	return cfg.parse()
+}
+
+// readFile reads a YAML config file into cfg. Unknown keys are rejected so
+// that typos do not go unnoticed.
+func (cfg *config) readFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read config: %w", err)
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && err != io.EOF {
+		return fmt.Errorf("parse config %q: %w", path, err)
+	}
+	for _, repo := range cfg.Repos {
+		if repo.Name == "" || repo.URL == "" {
+			return fmt.Errorf("parse config %q: repos need a name and a url", path)
+		}
+		cfg.Repo = append(cfg.Repo, repo.Name+"="+repo.URL)
+		for _, glob := range repo.Include {
+			cfg.RepoInclude = append(cfg.RepoInclude, repo.Name+"="+glob)
+		}
+		for _, glob := range repo.Exclude {
+			cfg.RepoExclude = append(cfg.RepoExclude, repo.Name+"="+glob)
+		}
+	}
+	cfg.Repos = nil
+	return nil
+}
+
+// settings is a checked config, parsed into the values the caches take.
+type settings struct {
+	config
+	missMode       provider.MissMode
+	checksumPolicy provider.ChecksumPolicy
+	maxSize        int64
+	upstreams      []provider.Upstream
+	npmUpstreams   []provider.Upstream
+	goUpstreams    []provider.Upstream
+	pypiUpstreams  []provider.Upstream
+	rawUpstreams   []provider.Upstream
+	access         access.Config
+	// mounts are the caches to serve: the top-level Maven cache, the
+	// per-format ones and those configured under mounts.
+	mounts []mount
+}
+
+// mount is a cache served below path of the artifact port, "" for the
+// top-level Maven cache. Its storage lives in the subdirectory sub.
+type mount struct {
+	path           string
+	format         provider.Format
+	sub            string
+	upstreams      []provider.Upstream
+	hosted         []string
+	missMode       provider.MissMode
+	checksumPolicy provider.ChecksumPolicy
+	negativeTTL    time.Duration
+	policy         provider.Policy
+}
+
+func (cfg config) parse() (settings, error) {
+	s := settings{config: cfg}
+	var err error
+	if s.missMode, err = provider.ParseMissMode(cfg.MissMode); err != nil {
+		return s, err
+	}
+	if s.checksumPolicy, err = provider.ParseChecksumPolicy(cfg.ChecksumPolicy); err != nil {
+		return s, err
+	}
+	if s.maxSize, err = provider.ParseSize(cfg.MaxSize); err != nil {
+		return s, fmt.Errorf("invalid max size: %w", err)
+	}
+	if s.maxSize > 0 && (cfg.EvictLow <= 0 || cfg.EvictHigh > 1 || cfg.EvictLow >= cfg.EvictHigh) {
+		return s, fmt.Errorf("invalid eviction watermarks %.2f/%.2f (expected 0 < low < high <= 1)", cfg.EvictLow, cfg.EvictHigh)
+	}
+	if cfg.RetryBackoff < 0 || cfg.RetryMaxBackoff < 0 {
+		return s, fmt.Errorf("invalid retry backoff %s/%s (expected durations of zero or more)", cfg.RetryBackoff, cfg.RetryMaxBackoff)
+	}
+	if cfg.BreakerThreshold < 0 || (cfg.BreakerThreshold > 0 && cfg.BreakerCooldown <= 0) {
+		return s, fmt.Errorf("invalid circuit breaker %d/%s (expected a threshold of zero or more and a positive cooldown)", cfg.BreakerThreshold, cfg.BreakerCooldown)
+	}
+
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		return s, errors.New("tls-cert and tls-key must be given together")
+	}
+	if cfg.ClientCA != "" && cfg.TLSCert == "" {
+		return s, errors.New("client-ca requires tls-cert and tls-key")
+	}
+	s.access = access.Config{ClientCerts: cfg.ClientCA != "", Rules: cfg.Access, Deploy: cfg.Deploy}
+	if err := s.access.Validate(); err != nil {
+		return s, fmt.Errorf("invalid access rules: %w", err)
+	}
+	if cfg.Htpasswd != "" {
+		if s.access.Users, err = readAccessFile(cfg.Htpasswd, access.ParseHtpasswd); err != nil {
+			return s, fmt.Errorf("invalid htpasswd file: %w", err)
+		}
+	}
+	if cfg.Tokens != "" {
+		if s.access.Tokens, err = readAccessFile(cfg.Tokens, access.ParseTokens); err != nil {
+			return s, fmt.Errorf("invalid tokens file: %w", err)
+		}
+	}
+
+	repos := cfg.Repo
+	if len(repos) == 0 {
+		repos = []string{"https://repo.maven.apache.org/maven2"}
+	}
+	for _, repo := range repos {
+		upstream, err := provider.ParseUpstream(repo)
+		if err != nil {
+			return s, fmt.Errorf("invalid repository: %w", err)
+		}
+		s.upstreams = append(s.upstreams, upstream)
+	}
+	if err := addRoutes(s.upstreams, cfg.RepoInclude, cfg.RepoExclude); err != nil {
+		return s, fmt.Errorf("invalid repository routing: %w", err)
+	}
+
+	for _, format := range []struct {
+		what      string
+		rawURL    string
+		upstreams *[]provider.Upstream
+	}{
+		{"npm registry", cfg.NPMRegistry, &s.npmUpstreams},
+		{"Go module proxy", cfg.GoProxy, &s.goUpstreams},
+		{"Python package index", cfg.PyPIIndex, &s.pypiUpstreams},
+	} {
+		if format.rawURL == "" {
+			continue
+		}
+		upstream, err := provider.ParseUpstream(format.rawURL)
+		if err != nil {
+			return s, fmt.Errorf("invalid %s: %w", format.what, err)
+		}
+		*format.upstreams = []provider.Upstream{upstream}
+	}
+	for _, raw := range cfg.Raw {
+		upstream, err := provider.ParseUpstream(raw)
+		switch {
+		case err != nil:
+		case strings.HasPrefix(upstream.Name, "."):
+			err = fmt.Errorf("invalid raw file tree name %q", upstream.Name)
+		case slices.ContainsFunc(s.rawUpstreams, func(u provider.Upstream) bool { return u.Name == upstream.Name }):
+			err = fmt.Errorf("duplicate raw file tree name %q", upstream.Name)
+		}
+		if err != nil {
+			return s, fmt.Errorf("invalid raw file tree: %w", err)
+		}
+		s.rawUpstreams = append(s.rawUpstreams, upstream)
+	}
+
+	var mounted []mount
+	for _, mc := range cfg.Mounts {
+		m, err := s.parseMount(mc)
+		if err != nil {
+			return s, fmt.Errorf("invalid mount %q: %w", mc.Path, err)
+		}
+		mounted = append(mounted, m)
+	}
+
+	lists := [][]provider.Upstream{s.upstreams, s.npmUpstreams, s.goUpstreams, s.pypiUpstreams, s.rawUpstreams}
+	for _, m := range mounted {
+		lists = append(lists, m.upstreams)
+	}
+	for name, cc := range cfg.Credentials {
+		creds, err := cc.load()
+		if err != nil {
+			return s, fmt.Errorf("invalid credentials for %q: %w", name, err)
+		}
+		found := false
+		for _, list := range lists {
+			for i := range list {
+				if list[i].Name == name {
+					list[i].Credentials, found = creds, true
+				}
+			}
+		}
+		if !found {
+			return s, fmt.Errorf("invalid credentials for %q: no such upstream", name)
+		}
+	}
+
+	// The top-level Maven cache keeps the whole artifact port unless mounts
+	// take over without top-level repositories being configured.
+	if len(cfg.Repo) > 0 || len(cfg.Mounts) == 0 {
+		s.mounts = append(s.mounts, s.defaultMount("", provider.FormatMaven, "", s.upstreams, cfg.Hosted))
+	}
+	for _, format := range []struct {
+		path      string
+		format    provider.Format
+		upstreams []provider.Upstream
+	}{
+		{"/npm", provider.FormatNPM, s.npmUpstreams},
+		{"/go", provider.FormatGo, s.goUpstreams},
+		{"/pypi", provider.FormatPyPI, s.pypiUpstreams},
+	} {
+		if len(format.upstreams) > 0 {
+			s.mounts = append(s.mounts, s.defaultMount(format.path, format.format, "."+strings.TrimPrefix(format.path, "/"), format.upstreams, nil))
+		}
+	}
+	for i, upstream := range s.rawUpstreams {
+		s.mounts = append(s.mounts, s.defaultMount("/raw/"+upstream.Name, provider.FormatRaw, path.Join(".raw", upstream.Name), s.rawUpstreams[i:i+1], nil))
+	}
+	// A mount inside another, or around one, would be routed to whichever
+	// the mux prefers.
+	for _, m := range mounted {
+		for _, other := range s.mounts {
+			if other.path != "" && (within(m.path, other.path) || within(other.path, m.path)) {
+				return s, fmt.Errorf("invalid mount %q: overlaps %q", m.path, other.path)
+			}
+		}
+		s.mounts = append(s.mounts, m)
+	}
+	for _, m := range s.mounts {
+		if len(m.hosted) > 0 && len(cfg.Deploy) == 0 {
+			return s, fmt.Errorf("hosted prefixes of %q need deploy rules granting uploads", "/"+strings.TrimPrefix(m.path, "/"))
+		}
+	}
+	return s, nil
+}
+
+// within reports whether p is prefix or lies below it.
+func within(p, prefix string) bool {
+	return p == prefix || strings.HasPrefix(p, prefix+"/")
+}
+
+// defaultMount returns a mount taking its policies from the top level.
+func (s settings) defaultMount(mountPath string, format provider.Format, sub string, upstreams []provider.Upstream, hosted []string) mount {
+	return mount{
+		path:           mountPath,
+		format:         format,
+		sub:            sub,
+		upstreams:      upstreams,
+		hosted:         hosted,
+		missMode:       s.missMode,
+		checksumPolicy: s.checksumPolicy,
+		negativeTTL:    s.NegativeTTL,
+		policy:         provider.Policy{MetadataMaxAge: s.MetadataMaxAge, SnapshotMaxAge: s.SnapshotMaxAge, RawMaxAge: s.RawMaxAge},
+	}
+}
+
+// parseMount checks mc and fills in what it leaves unset from the top level.
+// Mounted caches are stored below .mounts in the cache path.
+func (s settings) parseMount(mc mountConfig) (mount, error) {
+	if !strings.HasPrefix(mc.Path, "/") || mc.Path == "/" || path.Clean(mc.Path) != mc.Path {
+		return mount{}, errors.New("expected an absolute path such as /maven-public")
+	}
+	format, err := provider.ParseFormat(mc.Format)
+	if err != nil {
+		return mount{}, err
+	}
+	m := s.defaultMount(mc.Path, format, path.Join(".mounts", mc.Path), nil, mc.Hosted)
+	for _, repo := range mc.Repos {
+		if repo.Name == "" || repo.URL == "" {
+			return mount{}, errors.New("repos need a name and a url")
+		}
+		upstream, err := provider.ParseUpstream(repo.Name + "=" + repo.URL)
+		if err != nil {
+			return mount{}, fmt.Errorf("invalid repository: %w", err)
+		}
+		upstream.Include, upstream.Exclude = repo.Include, repo.Exclude
+		if err := upstream.Validate(); err != nil {
+			return mount{}, err
+		}
+		m.upstreams = append(m.upstreams, upstream)
+	}
+	if len(m.upstreams) == 0 && len(m.hosted) == 0 {
+		return mount{}, errors.New("no repos and nothing hosted")
+	}
+	if mc.MissMode != "" {
+		if m.missMode, err = provider.ParseMissMode(mc.MissMode); err != nil {
+			return mount{}, err
+		}
+	}
+	if mc.ChecksumPolicy != "" {
+		if m.checksumPolicy, err = provider.ParseChecksumPolicy(mc.ChecksumPolicy); err != nil {
+			return mount{}, err
+		}
+	}
+	for _, override := range []struct {
+		value *time.Duration
+		into  *time.Duration
+	}{
+		{mc.NegativeTTL, &m.negativeTTL},
+		{mc.MetadataMaxAge, &m.policy.MetadataMaxAge},
+		{mc.SnapshotMaxAge, &m.policy.SnapshotMaxAge},
+		{mc.RawMaxAge, &m.policy.RawMaxAge},
+	} {
+		if override.value != nil {
+			*override.into = *override.value
+		}
+	}
+	return m, nil
+}
+
+// mount returns the mount served below mountPath.
+func (s settings) mount(mountPath string) (mount, bool) {
+	for _, m := range s.mounts {
+		if m.path == mountPath {
+			return m, true
+		}
+	}
+	return mount{}, false
+}
+
+func readAccessFile(file string, parse func(io.Reader) (map[string]string, error)) (map[string]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parse(f)
+}
+
+// load reads the secrets cc refers to.
+func (cc credentialsConfig) load() (*provider.Credentials, error) {
+	password, err := readSecret("password", cc.PasswordFile, cc.PasswordEnv)
+	if err != nil {
+		return nil, err
+	}
+	token, err := readSecret("token", cc.TokenFile, cc.TokenEnv)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" && (cc.Username != "" || password != "") {
+		return nil, errors.New("a token cannot be combined with a username and password")
+	}
+	creds := &provider.Credentials{Username: cc.Username, Password: password, Token: token}
+
+	if (cc.CertFile == "") != (cc.KeyFile == "") {
+		return nil, errors.New("cert-file and key-file must be given together")
+	}
+	if cc.CertFile != "" || cc.CAFile != "" {
+		creds.TLS = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	if cc.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cc.CertFile, cc.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		creds.TLS.Certificates = []tls.Certificate{cert}
+	}
+	if cc.CAFile != "" {
+		pem, err := os.ReadFile(cc.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("read CA %q: no certificates found", cc.CAFile)
+		}
+		creds.TLS.RootCAs = pool
+	}
+	return creds, nil
+}
+
+// readSecret returns the secret stored in file or in the environment variable
+// env, without trailing newlines. Errors never include the secret.
+func readSecret(what, file, env string) (string, error) {
+	switch {
+	case file != "" && env != "":
+		return "", fmt.Errorf("%s-file and %s-env are mutually exclusive", what, what)
+	case file != "":
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("read %s: %w", what, err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	case env != "":
+		value, ok := os.LookupEnv(env)
+		if !ok {
+			return "", fmt.Errorf("read %s: environment variable %s is not set", what, env)
+		}
+		return value, nil
+	}
+	return "", nil
+}
+
+// cacheSettings returns what Reconfigure applies to the cache of m.
+func (s settings) cacheSettings(m mount) provider.Settings {
+	return provider.Settings{
+		Upstreams:      m.upstreams,
+		MissMode:       m.missMode,
+		NegativeTTL:    m.negativeTTL,
+		ChecksumPolicy: m.checksumPolicy,
+		Policy:         m.policy,
+		MaxSize:        s.maxSize,
+		EvictHigh:      s.EvictHigh,
+		EvictLow:       s.EvictLow,
+		Hosted:         m.hosted,
+		Retry:          provider.RetryPolicy{Attempts: s.RetryAttempts, Backoff: s.RetryBackoff, MaxBackoff: s.RetryMaxBackoff},
+		Breaker:        provider.BreakerPolicy{Threshold: s.BreakerThreshold, Cooldown: s.BreakerCooldown},
+	}
+}
+
+// restartRequired lists the keys whose change a reload cannot apply.
+func restartRequired(old, cur config) []string {
+	var keys []string
+	check := func(key string, a, b any) {
+		if !reflect.DeepEqual(a, b) {
+			keys = append(keys, key)
+		}
+	}
+	check("addr", old.Addr, cur.Addr)
+	check("maintenance-addr", old.MaintenanceAddr, cur.MaintenanceAddr)
+	check("path", old.Path, cur.Path)
+	check("workers", old.Workers, cur.Workers)
+	check("log-format", old.LogFormat, cur.LogFormat)
+	check("tls", []string{old.TLSCert, old.TLSKey, old.ClientCA}, []string{cur.TLSCert, cur.TLSKey, cur.ClientCA})
+	check("negative-persist", old.NegativePersist, cur.NegativePersist)
+	check("storage", []any{old.Storage, old.S3Endpoint, old.S3Bucket, old.S3Region, old.S3Prefix, old.S3PathStyle},
+		[]any{cur.Storage, cur.S3Endpoint, cur.S3Bucket, cur.S3Region, cur.S3Prefix, cur.S3PathStyle})
+	check("presign-hits", old.PresignHits, cur.PresignHits)
+	check("no-redirect-agent", old.NoRedirectAgents, cur.NoRedirectAgents)
+	check("npm-registry", old.NPMRegistry == "", cur.NPMRegistry == "")
+	check("go-proxy", old.GoProxy == "", cur.GoProxy == "")
+	check("go-sumdb", old.GoSumDB, cur.GoSumDB)
+	check("pypi-index", old.PyPIIndex == "", cur.PyPIIndex == "")
+	check("public-url", old.PublicURL, cur.PublicURL)
+	check("raw", rawNames(old.Raw), rawNames(cur.Raw))
+	check("repo", len(old.Repo) > 0 || len(old.Mounts) == 0, len(cur.Repo) > 0 || len(cur.Mounts) == 0)
+	check("mounts", mountLayout(old.Mounts), mountLayout(cur.Mounts))
+	return keys
+}
+
+// mountLayout returns the paths and formats of mounts, which decide the
+// routes of the artifact port.
+func mountLayout(mounts []mountConfig) []string {
+	var layout []string
+	for _, m := range mounts {
+		format, _ := provider.ParseFormat(m.Format)
+		layout = append(layout, m.Path+"="+format.String())
+	}
+	return layout
+}
+
+// rawNames returns the names of raw file trees, which decide their mounts.
+func rawNames(raws []string) []string {
+	var names []string
+	for _, raw := range raws {
+		if u, err := provider.ParseUpstream(raw); err == nil {
+			names = append(names, u.Name)
+		}
+	}
+	return names
+}
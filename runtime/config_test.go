@@ -0,0 +1,234 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "articache.yaml")
+	require.NoError(t, os.WriteFile(file, []byte(content), 0o644))
+	return file
+}
+
+func TestLoadConfig(t *testing.T) {
+	file := writeConfig(t, `
+miss-mode: proxy
+negative-ttl: 1m
+max-size: 10Gi
+no-redirect-agent: [legacy]
+repos:
+  - name: nexus
+    url: https://nexus.example.com/repository/maven-public
+    include: ["/com/ourcompany/**"]
+  - name: central
+    url: https://repo.maven.apache.org/maven2
+    exclude: ["/com/ourcompany/**"]
+`)
+	cfg, err := loadConfig([]string{"--config", file, "--negative-ttl", "5m", "--no-redirect-agent", "old-maven", "--no-redirect-agent", "curl"}, io.Discard)
+	require.NoError(t, err)
+
+	assert.Equal(t, "proxy", cfg.missMode.String())
+	assert.Equal(t, 5*time.Minute, cfg.NegativeTTL, "flags override the file")
+	assert.Equal(t, []string{"old-maven", "curl"}, cfg.NoRedirectAgents, "a repeated flag replaces the file's list")
+	assert.Equal(t, int64(10<<30), cfg.maxSize)
+	assert.Equal(t, 30*time.Minute, cfg.MetadataMaxAge, "unset keys keep their defaults")
+	assert.Equal(t, 30*time.Second, cfg.cacheSettings(cfg.mounts[0]).Breaker.Cooldown)
+	if assert.Len(t, cfg.upstreams, 2) {
+		assert.Equal(t, "nexus", cfg.upstreams[0].Name)
+		assert.Equal(t, []string{"/com/ourcompany/**"}, cfg.upstreams[0].Include)
+		assert.Equal(t, []string{"/com/ourcompany/**"}, cfg.upstreams[1].Exclude)
+	}
+
+	cfg, err = loadConfig(nil, io.Discard)
+	require.NoError(t, err)
+	assert.Equal(t, "https://repo.maven.apache.org/maven2", cfg.upstreams[0].URL)
+}
+
+func TestLoadConfigRejectsInvalidFiles(t *testing.T) {
+	for name, content := range map[string]string{
+		"unknown key":      "miss-mod: proxy\n",
+		"bad value":        "miss-mode: sometimes\n",
+		"bad duration":     "negative-ttl: soon\n",
+		"repo with no url": "repos:\n  - name: central\n",
+		"unknown route":    "repo-include: [nexus=/com/**]\n",
+		"no cooldown":      "breaker-cooldown: 0s\n",
+	} {
+		_, err := loadConfig([]string{"--config", writeConfig(t, content)}, io.Discard)
+		assert.Error(t, err, name)
+	}
+	_, err := loadConfig([]string{"--config", filepath.Join(t.TempDir(), "missing.yaml")}, io.Discard)
+	assert.Error(t, err)
+}
+
+func TestLoadCredentials(t *testing.T) {
+	password := filepath.Join(t.TempDir(), "password")
+	require.NoError(t, os.WriteFile(password, []byte("s3cret\n"), 0o600))
+	t.Setenv("ARTICACHE_TEST_TOKEN", "ghp_token")
+
+	file := writeConfig(t, `
+repos:
+  - name: nexus
+    url: https://nexus.example.com/repository/maven-public
+  - name: central
+    url: https://repo.maven.apache.org/maven2
+npm-registry: github=https://npm.pkg.github.com
+credentials:
+  nexus:
+    username: deployer
+    password-file: `+password+`
+  github:
+    token-env: ARTICACHE_TEST_TOKEN
+`)
+	cfg, err := loadConfig([]string{"--config", file}, io.Discard)
+	require.NoError(t, err)
+	if assert.NotNil(t, cfg.upstreams[0].Credentials) {
+		assert.Equal(t, "deployer", cfg.upstreams[0].Credentials.Username)
+		assert.Equal(t, "s3cret", cfg.upstreams[0].Credentials.Password, "trailing newlines are trimmed")
+	}
+	assert.Nil(t, cfg.upstreams[1].Credentials)
+	if assert.NotNil(t, cfg.npmUpstreams[0].Credentials) {
+		assert.Equal(t, "ghp_token", cfg.npmUpstreams[0].Credentials.Token)
+	}
+
+	for name, content := range map[string]string{
+		"unknown upstream":   "credentials:\n  nexus:\n    token-env: ARTICACHE_TEST_TOKEN\n",
+		"unset variable":     "credentials:\n  repo.maven.apache.org:\n    token-env: ARTICACHE_TEST_UNSET\n",
+		"missing file":       "credentials:\n  repo.maven.apache.org:\n    password-file: /nonexistent\n",
+		"token and password": "credentials:\n  repo.maven.apache.org:\n    username: u\n    token-env: ARTICACHE_TEST_TOKEN\n",
+		"cert without key":   "credentials:\n  repo.maven.apache.org:\n    cert-file: client.pem\n",
+	} {
+		_, err := loadConfig([]string{"--config", writeConfig(t, content)}, io.Discard)
+		if assert.Error(t, err, name) {
+			assert.NotContains(t, err.Error(), "ghp_token", name)
+		}
+	}
+}
+
+func TestLoadAccess(t *testing.T) {
+	dir := t.TempDir()
+	htpasswd := filepath.Join(dir, "htpasswd")
+	require.NoError(t, os.WriteFile(htpasswd, []byte("bob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"), 0o600))
+	tokens := filepath.Join(dir, "tokens")
+	require.NoError(t, os.WriteFile(tokens, []byte("ci:ci-token\n"), 0o600))
+
+	file := writeConfig(t, `
+htpasswd: `+htpasswd+`
+tokens: `+tokens+`
+hosted: [/com/ourcompany]
+access:
+  anonymous: [/org/apache/]
+  ci: [/]
+deploy:
+  ci: [/com/ourcompany/]
+`)
+	cfg, err := loadConfig([]string{"--config", file}, io.Discard)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"bob": "{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g="}, cfg.access.Users)
+	assert.Equal(t, map[string]string{"ci-token": "ci"}, cfg.access.Tokens)
+	assert.Equal(t, []string{"/"}, cfg.access.Rules["ci"])
+	assert.False(t, cfg.access.ClientCerts)
+	assert.Equal(t, []string{"/com/ourcompany/"}, cfg.access.Deploy["ci"])
+	root, ok := cfg.mount("")
+	require.True(t, ok)
+	assert.Equal(t, []string{"/com/ourcompany"}, cfg.cacheSettings(root).Hosted)
+
+	for name, args := range map[string][]string{
+		"relative prefix":     {"--config", writeConfig(t, "access:\n  ci: [com/ourcompany]\n")},
+		"relative deploy":     {"--config", writeConfig(t, "deploy:\n  ci: [com/ourcompany]\n")},
+		"hosted, no deploy":   {"--hosted", "/com/ourcompany"},
+		"missing htpasswd":    {"--htpasswd", filepath.Join(dir, "missing")},
+		"cert without key":    {"--tls-cert", "cert.pem"},
+		"client CA, no TLS":   {"--client-ca", "ca.pem"},
+		"unsupported hashing": {"--htpasswd", writeConfig(t, "carol:$apr1$salt$hash\n")},
+	} {
+		_, err := loadConfig(args, io.Discard)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestLoadMounts(t *testing.T) {
+	file := writeConfig(t, `
+snapshot-max-age: 10m
+npm-registry: https://registry.npmjs.org
+mounts:
+  - path: /maven-public
+    repos:
+      - name: central
+        url: https://repo.maven.apache.org/maven2
+      - name: google
+        url: https://maven.google.com
+        include: ["/com/google/**", "/androidx/**"]
+    metadata-max-age: 5m
+  - path: /maven-internal
+    hosted: [/]
+    miss-mode: proxy
+deploy:
+  "*": [/maven-internal/]
+`)
+	cfg, err := loadConfig([]string{"--config", file}, io.Discard)
+	require.NoError(t, err)
+
+	_, ok := cfg.mount("")
+	assert.False(t, ok, "mounts replace the top-level cache unless it has repositories of its own")
+	var paths []string
+	for _, m := range cfg.mounts {
+		paths = append(paths, m.path)
+	}
+	assert.Equal(t, []string{"/npm", "/maven-public", "/maven-internal"}, paths)
+
+	public, _ := cfg.mount("/maven-public")
+	assert.Equal(t, ".mounts/maven-public", public.sub)
+	if assert.Len(t, public.upstreams, 2) {
+		assert.Equal(t, []string{"/com/google/**", "/androidx/**"}, public.upstreams[1].Include)
+	}
+	assert.Equal(t, 5*time.Minute, public.policy.MetadataMaxAge)
+	assert.Equal(t, 10*time.Minute, public.policy.SnapshotMaxAge, "unset policies come from the top level")
+
+	internal, _ := cfg.mount("/maven-internal")
+	assert.Empty(t, internal.upstreams)
+	assert.Equal(t, []string{"/"}, internal.hosted)
+	assert.Equal(t, "proxy", internal.missMode.String())
+
+	cfg, err = loadConfig([]string{"--config", file, "--repo", "https://repo.maven.apache.org/maven2"}, io.Discard)
+	require.NoError(t, err)
+	_, ok = cfg.mount("")
+	assert.True(t, ok)
+
+	for name, content := range map[string]string{
+		"relative path":    "mounts:\n  - path: maven\n    hosted: [/]\n",
+		"root path":        "mounts:\n  - path: /\n    hosted: [/]\n",
+		"nothing to serve": "mounts:\n  - path: /empty\n",
+		"duplicate path":   "npm-registry: https://registry.npmjs.org\nmounts:\n  - path: /npm\n    format: npm\n    repos: [{name: npm, url: https://registry.npmjs.org}]\n",
+		"bad format":       "mounts:\n  - path: /cargo\n    format: cargo\n    hosted: [/]\n",
+		"nested mounts":    "mounts:\n  - path: /a\n    repos: [{name: a, url: https://a.example.com}]\n  - path: /a/b\n    repos: [{name: b, url: https://b.example.com}]\n",
+		"raw routes":       "raw: [gradle=https://services.gradle.org]\nmounts:\n  - path: /raw\n    repos: [{name: a, url: https://a.example.com}]\n",
+	} {
+		_, err := loadConfig([]string{"--config", writeConfig(t, content)}, io.Discard)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestRestartRequired(t *testing.T) {
+	old := defaultConfig()
+	cur := defaultConfig()
+	cur.MissMode = "proxy"
+	cur.Repo = []string{"https://nexus.example.com"}
+	cur.NPMRegistry = "https://registry.npmjs.org"
+	cur.Addr = ":9090"
+	assert.Equal(t, []string{"addr", "npm-registry"}, restartRequired(old, cur))
+
+	old.Mounts = []mountConfig{{Path: "/maven-internal", Hosted: []string{"/"}}}
+	cur = old
+	cur.Mounts = []mountConfig{{Path: "/maven-internal", Format: "maven", Hosted: []string{"/com/ourcompany"}}}
+	assert.Empty(t, restartRequired(old, cur), "mounted caches are reconfigured in place")
+	cur.Mounts = append(cur.Mounts, mountConfig{Path: "/maven-public"})
+	assert.Equal(t, []string{"mounts"}, restartRequired(old, cur))
+}
@@ -0,0 +1,262 @@
+// Package access authenticates clients of the artifact server and decides
+// which paths they may read and upload to.
+package access
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"articache/internal/metrics"
+)
+
+// Identities that rules can grant paths to besides named clients.
+const (
+	// Anonymous stands for clients that present no credentials.
+	Anonymous = "anonymous"
+	// Authenticated stands for every authenticated client.
+	Authenticated = "*"
+)
+
+// Config says how clients authenticate and what they may read.
+type Config struct {
+	// Users maps user names to password hashes, as read from an htpasswd
+	// file.
+	Users map[string]string
+	// Tokens maps static bearer tokens to the identity they authenticate.
+	Tokens map[string]string
+	// ClientCerts identifies clients by the common name of the verified TLS
+	// certificate they present.
+	ClientCerts bool
+	// Rules maps identities to the path prefixes they may read. Without
+	// rules, authenticated clients may read every path.
+	Rules map[string][]string
+	// Deploy maps identities to the path prefixes they may upload to, in the
+	// same way, except that without rules no client may upload.
+	Deploy map[string][]string
+}
+
+// open reports whether cfg lets every client read everywhere. Nobody may
+// upload then.
+func (cfg Config) open() bool {
+	return len(cfg.Users) == 0 && len(cfg.Tokens) == 0 && !cfg.ClientCerts && len(cfg.Rules) == 0 && len(cfg.Deploy) == 0
+}
+
+// Validate checks the rules of cfg.
+func (cfg Config) Validate() error {
+	for _, rules := range []map[string][]string{cfg.Rules, cfg.Deploy} {
+		for identity, prefixes := range rules {
+			for _, prefix := range prefixes {
+				if !strings.HasPrefix(prefix, "/") {
+					return fmt.Errorf("invalid path prefix %q for %q (expected an absolute path)", prefix, identity)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// ParseHtpasswd reads user:hash lines as written by htpasswd. Only bcrypt
+// (htpasswd -B) and SHA-1 ({SHA}) hashes are supported.
+func ParseHtpasswd(r io.Reader) (map[string]string, error) {
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(text, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("htpasswd line %d: expected user:hash", line)
+		}
+		if !strings.HasPrefix(hash, "$2") && !strings.HasPrefix(hash, "{SHA}") {
+			return nil, fmt.Errorf("htpasswd line %d: unsupported hash for %q (expected bcrypt or {SHA})", line, user)
+		}
+		users[user] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read htpasswd: %w", err)
+	}
+	return users, nil
+}
+
+// ParseTokens reads identity:token lines. Errors never include tokens.
+func ParseTokens(r io.Reader) (map[string]string, error) {
+	tokens := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		identity, token, ok := strings.Cut(text, ":")
+		if !ok || identity == "" || token == "" {
+			return nil, fmt.Errorf("tokens line %d: expected identity:token", line)
+		}
+		if _, dup := tokens[token]; dup {
+			return nil, fmt.Errorf("tokens line %d: token of %q is already used", line, identity)
+		}
+		tokens[token] = identity
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read tokens: %w", err)
+	}
+	return tokens, nil
+}
+
+// Guard enforces a Config in front of the artifact handlers.
+type Guard struct {
+	policy atomic.Pointer[policy]
+}
+
+// policy is a Config prepared for lookups.
+type policy struct {
+	Config
+	// tokens maps the SHA-256 of each token to its identity, so that
+	// lookups do not compare secrets byte by byte.
+	tokens map[[sha256.Size]byte]string
+	// verified remembers passwords that matched, as bcrypt is slow on
+	// purpose.
+	verified sync.Map
+}
+
+// NewGuard returns a guard enforcing cfg.
+func NewGuard(cfg Config) *Guard {
+	g := &Guard{}
+	g.Set(cfg)
+	return g
+}
+
+// Set replaces the configuration the guard enforces.
+func (g *Guard) Set(cfg Config) {
+	p := &policy{Config: cfg, tokens: make(map[[sha256.Size]byte]string, len(cfg.Tokens))}
+	for token, identity := range cfg.Tokens {
+		p.tokens[sha256.Sum256([]byte(token))] = identity
+	}
+	g.policy.Store(p)
+}
+
+// Handler returns next behind authentication and authorization. PUT
+// requests are checked against the deploy rules, all others against the read
+// rules. Unauthenticated clients asking for what they may not do are answered
+// 401, authenticated ones 403.
+func (g *Guard) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := g.policy.Load()
+		if p.open() && r.Method != http.MethodPut {
+			next.ServeHTTP(w, r)
+			return
+		}
+		name := path.Clean("/" + strings.TrimPrefix(r.URL.Path, "/"))
+		identity, ok := p.identify(r)
+		switch {
+		case !ok:
+			g.deny(w, r, name, "", http.StatusUnauthorized)
+		case p.allows(identity, name, r.Method == http.MethodPut):
+			next.ServeHTTP(w, r)
+		case identity == Anonymous:
+			g.deny(w, r, name, identity, http.StatusUnauthorized)
+		default:
+			g.deny(w, r, name, identity, http.StatusForbidden)
+		}
+	})
+}
+
+func (g *Guard) deny(w http.ResponseWriter, r *http.Request, name, identity string, status int) {
+	result := "forbidden"
+	if status == http.StatusUnauthorized {
+		result = "unauthorized"
+		w.Header().Set("WWW-Authenticate", `Basic realm="articache"`)
+	}
+	metrics.HTTPRequestsTotal.WithLabelValues(result).Inc()
+	http.Error(w, http.StatusText(status), status)
+	slog.Info("artifact request", "result", result, "path", name, "identity", identity, "status", status, "remote_addr", r.RemoteAddr)
+}
+
+// identify returns who sent r: the owner of its bearer token or basic auth
+// credentials, the subject of its client certificate, or Anonymous. It
+// reports false when r carries credentials that do not check out.
+func (p *policy) identify(r *http.Request) (string, bool) {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		if scheme, token, ok := strings.Cut(auth, " "); ok && strings.EqualFold(scheme, "Bearer") {
+			identity, ok := p.tokens[sha256.Sum256([]byte(strings.TrimSpace(token)))]
+			return identity, ok
+		}
+		user, password, ok := r.BasicAuth()
+		if !ok || !p.checkPassword(user, password) {
+			return "", false
+		}
+		return user, true
+	}
+	if p.ClientCerts && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+		if cn := r.TLS.VerifiedChains[0][0].Subject.CommonName; cn != "" {
+			return cn, true
+		}
+	}
+	return Anonymous, true
+}
+
+func (p *policy) checkPassword(user, password string) bool {
+	hash, ok := p.Users[user]
+	if !ok {
+		return false
+	}
+	key := sha256.Sum256([]byte(user + "\x00" + password))
+	if cached, ok := p.verified.Load(key); ok {
+		return cached.(bool)
+	}
+	var match bool
+	if sum, ok := strings.CutPrefix(hash, "{SHA}"); ok {
+		digest := sha1.Sum([]byte(password))
+		match = subtle.ConstantTimeCompare([]byte(sum), []byte(base64.StdEncoding.EncodeToString(digest[:]))) == 1
+	} else {
+		match = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+	if match {
+		p.verified.Store(key, true)
+	}
+	return match
+}
+
+// allows reports whether identity may read name, or upload it when write is
+// set.
+func (p *policy) allows(identity, name string, write bool) bool {
+	rules := p.Rules
+	if write {
+		rules = p.Deploy
+	}
+	if len(rules) == 0 {
+		return !write && identity != Anonymous
+	}
+	grants := [][]string{rules[Anonymous]}
+	if identity != Anonymous {
+		grants = append(grants, rules[Authenticated], rules[identity])
+	}
+	for _, prefixes := range grants {
+		for _, prefix := range prefixes {
+			if under(name, prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// under reports whether name is prefix or lies below it.
+func under(name, prefix string) bool {
+	prefix = strings.TrimRight(prefix, "/")
+	return prefix == "" || name == prefix || strings.HasPrefix(name, prefix+"/")
+}
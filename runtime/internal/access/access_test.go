@@ -0,0 +1,114 @@
+package access
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestParseHtpasswd(t *testing.T) {
+	users, err := ParseHtpasswd(strings.NewReader("# users\nalice:$2y$05$abc\nbob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n\n"))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"alice": "$2y$05$abc", "bob": "{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g="}, users)
+
+	_, err = ParseHtpasswd(strings.NewReader("carol:$apr1$salt$hash\n"))
+	assert.Error(t, err)
+	_, err = ParseHtpasswd(strings.NewReader("no separator\n"))
+	assert.Error(t, err)
+}
+
+func TestParseTokens(t *testing.T) {
+	tokens, err := ParseTokens(strings.NewReader("ci:ci-token\ndeploy:deploy-token\n"))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"ci-token": "ci", "deploy-token": "deploy"}, tokens)
+
+	_, err = ParseTokens(strings.NewReader("ci:same\ndeploy:same\n"))
+	if assert.Error(t, err) {
+		assert.NotContains(t, err.Error(), "same")
+	}
+}
+
+func TestGuard(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("alice-password"), bcrypt.MinCost)
+	require.NoError(t, err)
+	guard := NewGuard(Config{
+		Users:       map[string]string{"alice": string(hash), "bob": "{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g="}, // bob:password
+		Tokens:      map[string]string{"ci-token": "ci"},
+		ClientCerts: true,
+		Rules: map[string][]string{
+			Anonymous:     {"/org/apache/"},
+			Authenticated: {"/npm"},
+			"alice":       {"/com/ourcompany"},
+			"ci":          {"/"},
+			"builder":     {"/com/ourcompany/builds/"},
+		},
+	})
+	handler := guard.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	do := func(method, path string, authorize func(r *http.Request)) int {
+		r := httptest.NewRequest(method, path, nil)
+		authorize(r)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+	get := func(path string, authorize func(r *http.Request)) int {
+		return do(http.MethodGet, path, authorize)
+	}
+	anonymous := func(r *http.Request) {}
+	basic := func(user, password string) func(r *http.Request) {
+		return func(r *http.Request) { r.SetBasicAuth(user, password) }
+	}
+	bearer := func(token string) func(r *http.Request) {
+		return func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) }
+	}
+	cert := func(cn string) func(r *http.Request) {
+		return func(r *http.Request) {
+			r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: cn}}}}}
+		}
+	}
+
+	assert.Equal(t, http.StatusOK, get("/org/apache/commons/commons-lang3/3.0/commons-lang3-3.0.jar", anonymous))
+	assert.Equal(t, http.StatusUnauthorized, get("/com/ourcompany/lib/1.0/lib-1.0.jar", anonymous))
+	assert.Equal(t, http.StatusUnauthorized, get("/org/apache/../../com/ourcompany/lib/1.0/lib-1.0.jar", anonymous), "paths are cleaned")
+
+	assert.Equal(t, http.StatusOK, get("/com/ourcompany/lib/1.0/lib-1.0.jar", basic("alice", "alice-password")))
+	assert.Equal(t, http.StatusOK, get("/com/ourcompany/lib/1.0/lib-1.0.jar", basic("alice", "alice-password")), "verified passwords are remembered")
+	assert.Equal(t, http.StatusOK, get("/npm/left-pad", basic("alice", "alice-password")))
+	assert.Equal(t, http.StatusForbidden, get("/com/ourcompanyx/lib.jar", basic("alice", "alice-password")), "prefixes end at path segments")
+	assert.Equal(t, http.StatusUnauthorized, get("/com/ourcompany/lib.jar", basic("alice", "wrong")))
+	assert.Equal(t, http.StatusOK, get("/npm/left-pad", basic("bob", "password")))
+	assert.Equal(t, http.StatusForbidden, get("/com/ourcompany/lib.jar", basic("bob", "password")))
+
+	assert.Equal(t, http.StatusOK, get("/go/example.com/mod/@v/list", bearer("ci-token")))
+	assert.Equal(t, http.StatusUnauthorized, get("/go/example.com/mod/@v/list", bearer("other-token")))
+
+	assert.Equal(t, http.StatusOK, get("/com/ourcompany/builds/app.jar", cert("builder")))
+	assert.Equal(t, http.StatusForbidden, get("/com/ourcompany/lib.jar", cert("builder")))
+
+	assert.Equal(t, http.StatusForbidden, do(http.MethodPut, "/com/ourcompany/lib/1.0/lib-1.0.jar", basic("alice", "alice-password")), "uploads need a deploy rule")
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodPut, "/com/ourcompany/lib/1.0/lib-1.0.jar", anonymous))
+
+	guard.Set(Config{Tokens: map[string]string{"ci-token": "ci"}, Deploy: map[string][]string{"ci": {"/com/ourcompany/"}}})
+	assert.Equal(t, http.StatusOK, do(http.MethodPut, "/com/ourcompany/lib/1.0/lib-1.0.jar", bearer("ci-token")))
+	assert.Equal(t, http.StatusForbidden, do(http.MethodPut, "/org/apache/lib/1.0/lib-1.0.jar", bearer("ci-token")))
+	assert.Equal(t, http.StatusOK, get("/org/apache/lib/1.0/lib-1.0.jar", bearer("ci-token")), "deploy rules do not restrict reads")
+
+	guard.Set(Config{})
+	assert.Equal(t, http.StatusOK, get("/com/ourcompany/lib.jar", anonymous), "without configuration every client may read everything")
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodPut, "/com/ourcompany/lib/1.0/lib-1.0.jar", anonymous), "but nobody may upload")
+
+	guard.Set(Config{Tokens: map[string]string{"ci-token": "ci"}})
+	assert.Equal(t, http.StatusOK, get("/com/ourcompany/lib.jar", bearer("ci-token")), "without rules authenticated clients may read everything")
+	assert.Equal(t, http.StatusUnauthorized, get("/com/ourcompany/lib.jar", anonymous))
+}
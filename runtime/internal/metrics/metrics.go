@@ -15,7 +15,7 @@ var (
 			Name:      "http_requests_total",
 			Help:      "Total number of HTTP artifact requests handled by Articache.",
 		},
-		[]string{"result"}, // hit|miss|bad_request
+		[]string{"result"}, // hit|miss|not_found|bad_request|upload|unauthorized|forbidden
 	)
 
 	CacheHitsTotal = prometheus.NewCounter(
@@ -34,6 +34,63 @@ var (
 		},
 	)
 
+	NegativeCacheHitsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "articache",
+			Name:      "negative_cache_hits_total",
+			Help:      "Total number of requests answered 404 from the negative cache without contacting upstream.",
+		},
+	)
+
+	CacheSizeBytes = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "articache",
+			Name:      "cache_size_bytes",
+			Help:      "Total size of cached artifacts tracked by the evictor.",
+		},
+	)
+
+	EvictionsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "articache",
+			Name:      "evictions_total",
+			Help:      "Total number of artifacts evicted to stay below the cache size limit.",
+		},
+	)
+
+	EvictedBytesTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "articache",
+			Name:      "evicted_bytes_total",
+			Help:      "Total number of bytes freed by evicting artifacts.",
+		},
+	)
+
+	RevalidationsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "articache",
+			Name:      "revalidations_total",
+			Help:      "Total number of upstream revalidations of stale mutable artifacts.",
+		},
+		[]string{"outcome"}, // not_modified|updated|error
+	)
+
+	ChecksumFailuresTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "articache",
+			Name:      "checksum_failures_total",
+			Help:      "Total number of downloads discarded because they did not match the upstream checksum.",
+		},
+	)
+
+	CoalescedRequestsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "articache",
+			Name:      "coalesced_requests_total",
+			Help:      "Total number of fetches that joined an upstream transfer already in flight instead of starting their own.",
+		},
+	)
+
 	DownloadQueuedTotal = prometheus.NewCounter(
 		prometheus.CounterOpts{
 			Namespace: "articache",
@@ -46,7 +103,7 @@ var (
 		prometheus.CounterOpts{
 			Namespace: "articache",
 			Name:      "downloads_queue_dropped_total",
-			Help:      "Total number of async download jobs dropped due to a full queue.",
+			Help:      "Total number of async download jobs dropped because the queue was full or could not be written.",
 		},
 	)
 
@@ -83,6 +140,23 @@ var (
 			Buckets:   prometheus.DefBuckets,
 		},
 	)
+
+	DownloadRetriesTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "articache",
+			Name:      "download_retries_total",
+			Help:      "Total number of upstream downloads retried after a transient failure.",
+		},
+	)
+
+	UpstreamCircuitState = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "articache",
+			Name:      "upstream_circuit_state",
+			Help:      "State of the circuit breaker of each upstream: 0 closed, 1 half-open, 2 open.",
+		},
+		[]string{"upstream", "url"},
+	)
 )
 
 func Register(reg prometheus.Registerer) {
@@ -91,12 +165,21 @@ func Register(reg prometheus.Registerer) {
 			HTTPRequestsTotal,
 			CacheHitsTotal,
 			CacheMissesTotal,
+			NegativeCacheHitsTotal,
+			CacheSizeBytes,
+			EvictionsTotal,
+			EvictedBytesTotal,
+			RevalidationsTotal,
+			ChecksumFailuresTotal,
+			CoalescedRequestsTotal,
 			DownloadQueuedTotal,
 			DownloadQueueDroppedTotal,
 			DownloadQueueDepth,
 			DownloadsInflight,
 			DownloadsTotal,
 			DownloadDurationSeconds,
+			DownloadRetriesTotal,
+			UpstreamCircuitState,
 		)
 	})
 }
@@ -0,0 +1,236 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultListLimit caps the number of entries returned by a listing unless the
+// client asks for more.
+const defaultListLimit = 1000
+
+// entryInfo describes a cached artifact in admin API responses.
+type entryInfo struct {
+	Path          string    `json:"path"`
+	Size          int64     `json:"size"`
+	ModTime       time.Time `json:"mtime"`
+	Repository    string    `json:"repository,omitempty"`
+	RepositoryURL string    `json:"repository_url,omitempty"`
+	FetchedAt     time.Time `json:"fetched_at,omitzero"`
+}
+
+// AdminHandler returns the admin API, meant to be mounted under /admin/ on the
+// maintenance listener:
+//
+//	GET    /admin/entries?prefix=/org/example&limit=100  list cached artifacts
+//	GET    /admin/entries/{path}                         stat one artifact
+//	DELETE /admin/entries/{path}                         delete an artifact or a whole prefix
+//	POST   /admin/prefetch                               queue downloads: {"paths": ["/org/..."]}
+//	POST   /admin/prefetch/coordinates                   warm up from group:artifact:version[:classifier][@ext] lines
+//	POST   /admin/prefetch/pom                           warm up from a pom.xml or BOM
+//	GET    /admin/prefetch/{id}                          progress of a coordinate or POM warm-up
+//	GET    /admin/upstreams                              upstreams and the state of their circuit breakers
+func (c *Cache) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/entries", c.handleListEntries)
+	mux.HandleFunc("GET /admin/entries/{path...}", c.handleStatEntry)
+	mux.HandleFunc("DELETE /admin/entries/{path...}", c.handleDeleteEntries)
+	mux.HandleFunc("POST /admin/prefetch", c.handlePrefetch)
+	mux.HandleFunc("POST /admin/prefetch/coordinates", c.handlePrefetchCoordinates)
+	mux.HandleFunc("POST /admin/prefetch/pom", c.handlePrefetchPOM)
+	mux.HandleFunc("GET /admin/prefetch/{id}", c.handlePrefetchStatus)
+	mux.HandleFunc("GET /admin/upstreams", c.handleUpstreams)
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Warn("failed to write admin response", "error", err)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// entry builds the admin view of a stored artifact.
+func (c *Cache) entry(ctx context.Context, info ObjectInfo) entryInfo {
+	e := entryInfo{Path: info.Name, Size: info.Size, ModTime: info.ModTime.UTC()}
+	if meta, err := readMeta(ctx, c.storage, info.Name); err == nil {
+		e.RepositoryURL = meta.Repository
+		e.Repository = c.upstreamName(meta.Repository)
+		e.FetchedAt = meta.FetchedAt
+	}
+	return e
+}
+
+// upstreamName returns the configured name of the upstream at repoURL.
+func (c *Cache) upstreamName(repoURL string) string {
+	for _, u := range c.upstreamList() {
+		if u.URL == strings.TrimRight(repoURL, "/") {
+			return u.Name
+		}
+	}
+	return upstreamName(repoURL)
+}
+
+// walkEntries calls fn for every cached artifact under prefix, skipping
+// articache's own bookkeeping.
+func (c *Cache) walkEntries(ctx context.Context, prefix string, fn func(info ObjectInfo) error) error {
+	return c.storage.List(ctx, prefix, func(info ObjectInfo) error {
+		if reservedName(info.Name) {
+			return nil
+		}
+		return fn(info)
+	})
+}
+
+var errListLimit = errors.New("list limit reached")
+
+func (c *Cache) handleListEntries(w http.ResponseWriter, r *http.Request) {
+	root := "/"
+	if prefix := r.URL.Query().Get("prefix"); prefix != "" && prefix != "/" {
+		name, err := artifactName(prefix)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		root = name
+	}
+	limit := defaultListLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid limit %q", v))
+			return
+		}
+		limit = n
+	}
+
+	entries := make([]entryInfo, 0)
+	err := c.walkEntries(r.Context(), root, func(info ObjectInfo) error {
+		if len(entries) == limit {
+			return errListLimit
+		}
+		entries = append(entries, c.entry(r.Context(), info))
+		return nil
+	})
+	truncated := errors.Is(err, errListLimit)
+	if err != nil && !truncated {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"entries": entries, "truncated": truncated})
+}
+
+func (c *Cache) handleStatEntry(w http.ResponseWriter, r *http.Request) {
+	name, err := artifactName(r.PathValue("path"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	info, ok := c.lookup(r.Context(), name)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("%q is not cached", name))
+		return
+	}
+	writeJSON(w, http.StatusOK, c.entry(r.Context(), info))
+}
+
+func (c *Cache) handleDeleteEntries(w http.ResponseWriter, r *http.Request) {
+	name, err := artifactName(r.PathValue("path"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var deleted int
+	var freed int64
+	err = c.walkEntries(r.Context(), name, func(info ObjectInfo) error {
+		if err := c.removeEntry(r.Context(), info.Name); err != nil {
+			return err
+		}
+		deleted++
+		freed += info.Size
+		return nil
+	})
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if deleted == 0 {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("%q is not cached", name))
+		return
+	}
+	if p, ok := c.storage.(Pruner); ok {
+		for _, prefix := range []string{name, path.Join("/", metaDirName, "meta", name)} {
+			if err := p.Prune(r.Context(), prefix); err != nil {
+				slog.Warn("failed to remove empty directories", "path", prefix, "error", err)
+			}
+		}
+	}
+	slog.Info("cache entries deleted", "path", name, "deleted", deleted, "freed_bytes", freed)
+	writeJSON(w, http.StatusOK, map[string]any{"deleted": deleted, "freed_bytes": freed})
+}
+
+// removeEntry deletes a cached artifact and its metadata.
+func (c *Cache) removeEntry(ctx context.Context, name string) error {
+	if err := c.storage.Delete(ctx, name); err != nil {
+		return err
+	}
+	_ = c.storage.Delete(ctx, metaName(name))
+	c.evictor.removed(name)
+	return nil
+}
+
+type prefetchRequest struct {
+	Paths []string `json:"paths"`
+}
+
+type prefetchResult struct {
+	Path   string `json:"path"`
+	Status string `json:"status"` // queued|cached|not_found|dropped|invalid
+}
+
+func (c *Cache) handlePrefetch(w http.ResponseWriter, r *http.Request) {
+	var req prefetchRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("decode request: %w", err))
+		return
+	}
+
+	results := make([]prefetchResult, 0, len(req.Paths))
+	for _, name := range req.Paths {
+		results = append(results, prefetchResult{Path: name, Status: c.prefetch(r, name)})
+	}
+	writeJSON(w, http.StatusAccepted, map[string]any{"results": results})
+}
+
+// prefetch queues a background download of name unless it is cached already.
+func (c *Cache) prefetch(r *http.Request, name string) string {
+	name, err := artifactName(name)
+	if err != nil {
+		return "invalid"
+	}
+	if _, ok := c.lookup(r.Context(), name); ok {
+		return "cached"
+	}
+	upstream, ok := c.locate(r.Context(), name)
+	if !ok {
+		return "not_found"
+	}
+	if !c.enqueue(c.artifact(name, upstream.URL)) {
+		return "dropped"
+	}
+	return "queued"
+}
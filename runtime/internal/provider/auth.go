@@ -0,0 +1,93 @@
+package provider
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// redacted stands in for secrets wherever credentials would be printed.
+const redacted = "[REDACTED]"
+
+// Credentials authenticate the cache to an upstream. Formatting or logging
+// them yields a placeholder, never the secrets.
+type Credentials struct {
+	Username string
+	Password string
+	// Token is sent as a bearer token in place of Username and Password.
+	Token string
+	// TLS configures connections to the upstream, e.g. with a client
+	// certificate for mutual TLS or a private CA.
+	TLS *tls.Config
+
+	once   sync.Once
+	client *http.Client
+}
+
+func (c *Credentials) String() string       { return redacted }
+func (c *Credentials) GoString() string     { return redacted }
+func (c *Credentials) LogValue() slog.Value { return slog.StringValue(redacted) }
+
+// authorize adds the credentials to req.
+func (c *Credentials) authorize(req *http.Request) {
+	switch {
+	case c.Token != "":
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	case c.Username != "" || c.Password != "":
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+}
+
+// httpClient returns base, or a copy of it that connects with c.TLS.
+func (c *Credentials) httpClient(base *http.Client) *http.Client {
+	if c.TLS == nil {
+		return base
+	}
+	c.once.Do(func() {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		if t, ok := base.Transport.(*http.Transport); ok {
+			transport = t.Clone()
+		}
+		transport.TLSClientConfig = c.TLS
+		client := *base
+		client.Transport = transport
+		c.client = &client
+	})
+	return c.client
+}
+
+// send performs req on behalf of ap, authenticating it when it goes to the
+// origin of ap's upstream. Other hosts, such as the CDN a package index
+// links its files to, never see the credentials.
+func (d *HTTPDownloader) send(req *http.Request, ap artifactPath) (*http.Response, error) {
+	creds := ap.credentials
+	if creds == nil || !sameOrigin(req.URL, ap.repository) {
+		return d.httpClient.Do(req)
+	}
+	creds.authorize(req)
+	return creds.httpClient(d.httpClient).Do(req)
+}
+
+func sameOrigin(u *url.URL, repository string) bool {
+	r, err := url.Parse(repository)
+	return err == nil && strings.EqualFold(u.Scheme, r.Scheme) && strings.EqualFold(u.Host, r.Host)
+}
+
+// redactURL hides the user information of a URL that may not parse.
+func redactURL(rawURL string) string {
+	scheme, rest, ok := strings.Cut(rawURL, "://")
+	if !ok {
+		return rawURL
+	}
+	end := strings.IndexAny(rest, "/?#")
+	if end < 0 {
+		end = len(rest)
+	}
+	if at := strings.LastIndex(rest[:end], "@"); at >= 0 {
+		return scheme + "://" + redacted + rest[at:]
+	}
+	return rawURL
+}
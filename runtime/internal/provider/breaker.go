@@ -0,0 +1,234 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"articache/internal/metrics"
+)
+
+// BreakerPolicy controls the circuit breaker kept for each upstream.
+type BreakerPolicy struct {
+	// Threshold is how many failures in a row open the breaker of an
+	// upstream, after which no requests are sent to it; 0 disables breakers.
+	Threshold int
+	// Cooldown is how long an open breaker keeps traffic away before letting
+	// a single trial request through. The breaker closes when the trial
+	// succeeds and opens again when it fails.
+	Cooldown time.Duration
+}
+
+// DefaultBreakerPolicy opens a breaker after 5 failures in a row for 30s.
+func DefaultBreakerPolicy() BreakerPolicy {
+	return BreakerPolicy{Threshold: 5, Cooldown: 30 * time.Second}
+}
+
+func (p BreakerPolicy) validate() error {
+	if p.Threshold < 0 || (p.Threshold > 0 && p.Cooldown <= 0) {
+		return fmt.Errorf("invalid circuit breaker %d/%s (expected a threshold of zero or more and a positive cooldown)", p.Threshold, p.Cooldown)
+	}
+	return nil
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerHalfOpen:
+		return "half-open"
+	case breakerOpen:
+		return "open"
+	default:
+		return "closed"
+	}
+}
+
+// errCircuitOpen is returned when every upstream that might have an artifact
+// is held back by its circuit breaker.
+var errCircuitOpen = errors.New("upstream circuit open")
+
+type breaker struct {
+	state    breakerState
+	failures int
+	// since is when the breaker last opened or let a trial request through.
+	since   time.Time
+	lastErr string
+}
+
+// breakers tracks the health of the upstreams of a cache by URL.
+type breakers struct {
+	mu     sync.Mutex
+	policy BreakerPolicy
+	byURL  map[string]*breaker
+}
+
+func newBreakers(p BreakerPolicy) *breakers {
+	return &breakers{policy: p, byURL: make(map[string]*breaker)}
+}
+
+func (bs *breakers) setPolicy(p BreakerPolicy) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	bs.policy = p
+}
+
+func (bs *breakers) get(u Upstream) *breaker {
+	b, ok := bs.byURL[u.URL]
+	if !ok {
+		b = &breaker{}
+		bs.byURL[u.URL] = b
+	}
+	return b
+}
+
+// allow reports whether a request may be sent to u. An open breaker whose
+// cooldown has passed lets one trial request through per cooldown.
+func (bs *breakers) allow(u Upstream) bool {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	b, ok := bs.byURL[u.URL]
+	if !ok || b.state == breakerClosed || bs.policy.Threshold <= 0 {
+		return true
+	}
+	if time.Since(b.since) < bs.policy.Cooldown {
+		return false
+	}
+	b.state, b.since = breakerHalfOpen, time.Now()
+	metrics.UpstreamCircuitState.WithLabelValues(u.Name, u.URL).Set(float64(b.state))
+	slog.Info("upstream circuit half-open; sending a trial request", "repository", u.Name)
+	return true
+}
+
+// blocked reports whether the breaker of u keeps requests away, without
+// letting a trial request through: it is open and cooling down, or half-open
+// with its trial request still in flight.
+func (bs *breakers) blocked(u Upstream) bool {
+	return bs.cooling(u, breakerOpen) || bs.cooling(u, breakerHalfOpen)
+}
+
+// cooling reports whether the breaker of u has been in state for less than
+// the cooldown.
+func (bs *breakers) cooling(u Upstream, state breakerState) bool {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	b, ok := bs.byURL[u.URL]
+	return ok && b.state == state && bs.policy.Threshold > 0 && time.Since(b.since) < bs.policy.Cooldown
+}
+
+// record counts the outcome of a request to u.
+func (bs *breakers) record(u Upstream, err error) {
+	failed := upstreamFailed(err)
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if bs.policy.Threshold <= 0 {
+		return
+	}
+	b := bs.get(u)
+	if !failed {
+		if b.state != breakerClosed {
+			slog.Info("upstream circuit closed", "repository", u.Name)
+		}
+		b.state, b.failures = breakerClosed, 0
+		metrics.UpstreamCircuitState.WithLabelValues(u.Name, u.URL).Set(float64(b.state))
+		return
+	}
+	b.failures++
+	b.lastErr = err.Error()
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.failures >= bs.policy.Threshold) {
+		b.state, b.since = breakerOpen, time.Now()
+		metrics.UpstreamCircuitState.WithLabelValues(u.Name, u.URL).Set(float64(b.state))
+		slog.Warn("upstream circuit opened", "repository", u.Name, "failures", b.failures, "cooldown", bs.policy.Cooldown, "error", err)
+	}
+}
+
+// upstreamFailed reports whether err says that upstream is unwell, as opposed
+// to the artifact missing or failing verification, or the client going away.
+func upstreamFailed(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var ue *url.Error
+	return transient(err) || errors.As(err, &ue)
+}
+
+// SetBreakerPolicy sets when the circuit breakers of the upstreams open.
+func (c *Cache) SetBreakerPolicy(p BreakerPolicy) {
+	c.breakers.setPolicy(p)
+}
+
+// observeUpstream feeds the outcome of a request to repository into its
+// circuit breaker.
+func (c *Cache) observeUpstream(repository string, err error) {
+	if u, ok := c.upstreamByURL(repository); ok {
+		c.breakers.record(u, err)
+	}
+}
+
+// repositoryBlocked reports whether the breaker of repository is open. A
+// half-open breaker does not block: the download may be its trial request.
+func (c *Cache) repositoryBlocked(repository string) bool {
+	u, ok := c.upstreamByURL(repository)
+	return ok && c.breakers.cooling(u, breakerOpen)
+}
+
+func (c *Cache) upstreamByURL(repository string) (Upstream, bool) {
+	for _, u := range c.upstreamList() {
+		if u.URL == strings.TrimRight(repository, "/") {
+			return u, true
+		}
+	}
+	return Upstream{}, false
+}
+
+// circuitOpen reports whether an upstream that may serve name is held back
+// by its circuit breaker.
+func (c *Cache) circuitOpen(name string) bool {
+	for _, u := range c.upstreamList() {
+		if u.Allows(name) && !c.negatives.has(u.URL, name) && c.breakers.blocked(u) {
+			return true
+		}
+	}
+	return false
+}
+
+// upstreamStatus describes an upstream and its circuit breaker in admin API
+// responses.
+type upstreamStatus struct {
+	Name      string    `json:"name"`
+	URL       string    `json:"url"`
+	State     string    `json:"state"`
+	Failures  int       `json:"failures"`
+	Since     time.Time `json:"since,omitzero"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+func (c *Cache) handleUpstreams(w http.ResponseWriter, r *http.Request) {
+	upstreams := c.upstreamList()
+	out := make([]upstreamStatus, 0, len(upstreams))
+	c.breakers.mu.Lock()
+	for _, u := range upstreams {
+		s := upstreamStatus{Name: u.Name, URL: u.URL, State: breakerClosed.String()}
+		if b, ok := c.breakers.byURL[u.URL]; ok {
+			s.State, s.Failures, s.LastError = b.state.String(), b.failures, b.lastErr
+			if b.state != breakerClosed {
+				s.Since = b.since.UTC()
+			}
+		}
+		out = append(out, s)
+	}
+	c.breakers.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]any{"upstreams": out})
+}
@@ -0,0 +1,253 @@
+package provider
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// ChecksumPolicy controls whether downloads are verified against the checksum
+// files published next to them upstream.
+type ChecksumPolicy int
+
+const (
+	// ChecksumWarn verifies downloads that have a checksum file upstream and
+	// accepts those that do not.
+	ChecksumWarn ChecksumPolicy = iota
+	// ChecksumStrict rejects downloads without a matching checksum file.
+	ChecksumStrict
+	// ChecksumOff disables verification.
+	ChecksumOff
+)
+
+func ParseChecksumPolicy(policy string) (ChecksumPolicy, error) {
+	switch strings.ToLower(strings.TrimSpace(policy)) {
+	case "", "warn":
+		return ChecksumWarn, nil
+	case "strict":
+		return ChecksumStrict, nil
+	case "off":
+		return ChecksumOff, nil
+	default:
+		return ChecksumWarn, fmt.Errorf("invalid checksum policy %q (expected warn, strict or off)", policy)
+	}
+}
+
+func (p ChecksumPolicy) String() string {
+	switch p {
+	case ChecksumStrict:
+		return "strict"
+	case ChecksumOff:
+		return "off"
+	default:
+		return "warn"
+	}
+}
+
+// SetChecksumPolicy sets how the built-in HTTP downloader verifies downloads.
+func (c *Cache) SetChecksumPolicy(p ChecksumPolicy) {
+	if d, ok := c.downloader.(*HTTPDownloader); ok {
+		d.checksumPolicy.Store(int32(p))
+	}
+}
+
+func (d *HTTPDownloader) policy() ChecksumPolicy {
+	return ChecksumPolicy(d.checksumPolicy.Load())
+}
+
+// ErrChecksumMismatch is returned when a downloaded artifact does not match
+// its published checksum.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// checksumAlgorithms lists the checksum file extensions in the order they are
+// looked up upstream. Maven repositories publish .sha1 for every artifact, so
+// it comes first to avoid needless 404s.
+var checksumAlgorithms = []struct {
+	ext string
+	new func() hash.Hash
+}{
+	{"sha1", sha1.New},
+	{"sha256", sha256.New},
+	{"sha512", sha512.New},
+	{"md5", md5.New},
+}
+
+// isChecksumFile reports whether name is itself a checksum or signature file,
+// which are not verified.
+func isChecksumFile(name string) bool {
+	for _, ext := range []string{".sha1", ".sha256", ".sha512", ".md5", ".asc"} {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// hashingWriter computes every supported digest of the bytes written to it.
+type hashingWriter struct {
+	hashes map[string]hash.Hash
+	w      io.Writer
+}
+
+func newHashingWriter() *hashingWriter {
+	hw := &hashingWriter{hashes: make(map[string]hash.Hash, len(checksumAlgorithms))}
+	writers := make([]io.Writer, 0, len(checksumAlgorithms))
+	for _, alg := range checksumAlgorithms {
+		h := alg.new()
+		hw.hashes[alg.ext] = h
+		writers = append(writers, h)
+	}
+	hw.w = io.MultiWriter(writers...)
+	return hw
+}
+
+func (hw *hashingWriter) Write(p []byte) (int, error) {
+	return hw.w.Write(p)
+}
+
+func (hw *hashingWriter) sum(alg string) string {
+	return hex.EncodeToString(hw.hashes[alg].Sum(nil))
+}
+
+// digests returns the digests recorded in the artifact's metadata.
+func (hw *hashingWriter) digests() map[string]string {
+	return map[string]string{"sha1": hw.sum("sha1"), "sha256": hw.sum("sha256")}
+}
+
+// verifyingReader runs verify once r is exhausted and reports its failure in
+// place of io.EOF, so that the consumer never sees a complete, unverified body.
+type verifyingReader struct {
+	r      io.Reader
+	verify func() error
+	done   bool
+	err    error
+}
+
+func (vr *verifyingReader) Read(p []byte) (int, error) {
+	if vr.done {
+		if vr.err != nil {
+			return 0, vr.err
+		}
+		return 0, io.EOF
+	}
+	n, err := vr.r.Read(p)
+	if err == io.EOF {
+		vr.done = true
+		if vr.err = vr.verify(); vr.err != nil {
+			return n, vr.err
+		}
+	}
+	return n, err
+}
+
+// verify compares the computed digests with the first usable checksum file
+// found next to downloadURL. Unusable checksum files (failed requests, or
+// repositories answering with an HTML page) are skipped unless the policy is
+// strict.
+func (d *HTTPDownloader) verify(ctx context.Context, ap artifactPath, downloadURL string, hw *hashingWriter) error {
+	for _, alg := range checksumAlgorithms {
+		expected, err := d.fetchChecksum(ctx, ap, downloadURL+"."+alg.ext, alg.new().Size())
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			if d.policy() == ChecksumStrict {
+				return err
+			}
+			slog.Warn("ignoring unusable checksum file", "url", downloadURL+"."+alg.ext, "error", err)
+			continue
+		}
+		if actual := hw.sum(alg.ext); actual != expected {
+			return &checksumError{url: downloadURL, algorithm: alg.ext, expected: expected, actual: actual}
+		}
+		return nil
+	}
+	if d.policy() == ChecksumStrict {
+		return fmt.Errorf("verify %q: no checksum file found upstream", downloadURL)
+	}
+	return nil
+}
+
+func (d *HTTPDownloader) fetchChecksum(ctx context.Context, ap artifactPath, checksumURL string, size int) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, checksumURL, nil)
+	if err != nil {
+		return "", fmt.Errorf("create request: %w", err)
+	}
+	resp, err := d.send(req, ap)
+	if err != nil {
+		return "", fmt.Errorf("download %q: %w", checksumURL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return "", ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return "", fmt.Errorf("download %q: unexpected status %d", checksumURL, resp.StatusCode)
+	}
+	// Checksum files hold the hex digest, optionally followed by a file name.
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return "", fmt.Errorf("read %q: %w", checksumURL, err)
+	}
+	fields := strings.Fields(string(body))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("read %q: empty checksum file", checksumURL)
+	}
+	digest := strings.ToLower(fields[0])
+	if raw, err := hex.DecodeString(digest); err != nil || len(raw) != size {
+		return "", fmt.Errorf("read %q: malformed checksum %q", checksumURL, fields[0])
+	}
+	return digest, nil
+}
+
+// expectedDigest is the digest of a file as published in its format's
+// metadata, such as an npm packument. An empty algorithm means the metadata
+// did not list the file.
+type expectedDigest struct {
+	alg string // a checksumAlgorithms extension
+	hex string
+}
+
+// verifyDigest compares the computed digests with the digest the format's
+// metadata published for downloadURL.
+func (d *HTTPDownloader) verifyDigest(downloadURL string, expected expectedDigest, hw *hashingWriter) error {
+	if expected.alg == "" {
+		if d.policy() == ChecksumStrict {
+			return fmt.Errorf("verify %q: no digest published", downloadURL)
+		}
+		slog.Warn("no digest published; storing unverified", "url", downloadURL)
+		return nil
+	}
+	if actual := hw.sum(expected.alg); actual != expected.hex {
+		return &checksumError{url: downloadURL, algorithm: expected.alg, expected: expected.hex, actual: actual}
+	}
+	return nil
+}
+
+type checksumError struct {
+	url       string
+	algorithm string
+	expected  string
+	actual    string
+}
+
+func (e *checksumError) Error() string {
+	return fmt.Sprintf("verify %q: %s %s does not match published %s", e.url, e.algorithm, e.actual, e.expected)
+}
+
+func (e *checksumError) Unwrap() error {
+	return ErrChecksumMismatch
+}
@@ -0,0 +1,247 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"articache/internal/metrics"
+)
+
+// ParseSize parses a byte size such as "500M", "20Gi" or "1073741824".
+// Decimal (K, M, G, T) and binary (Ki, Mi, Gi, Ti) suffixes are accepted, with
+// an optional trailing "B".
+func ParseSize(s string) (int64, error) {
+	trimmed := strings.TrimSuffix(strings.TrimSpace(s), "B")
+	units := []struct {
+		suffix string
+		factor int64
+	}{
+		{"Ki", 1 << 10}, {"Mi", 1 << 20}, {"Gi", 1 << 30}, {"Ti", 1 << 40},
+		{"K", 1e3}, {"M", 1e6}, {"G", 1e9}, {"T", 1e12},
+	}
+	factor := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(trimmed, u.suffix) {
+			trimmed, factor = strings.TrimSuffix(trimmed, u.suffix), u.factor
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(trimmed), 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * float64(factor)), nil
+}
+
+// evictor keeps the cache below a size limit by deleting the least recently
+// used artifacts. Usage above the high watermark triggers an eviction pass
+// that runs until usage drops below the low watermark.
+type evictor struct {
+	store Storage
+	// exempt reports artifacts that are never evicted.
+	exempt  func(name string) bool
+	maxSize int64
+	high    int64
+	low     int64
+	trigger chan struct{}
+
+	mu      sync.Mutex
+	entries map[string]*evictEntry // artifact name -> entry
+	total   int64
+}
+
+type evictEntry struct {
+	size       int64
+	lastAccess time.Time
+}
+
+func newEvictor(store Storage, maxSize int64, high, low float64) *evictor {
+	return &evictor{
+		store:   store,
+		maxSize: maxSize,
+		high:    int64(float64(maxSize) * high),
+		low:     int64(float64(maxSize) * low),
+		trigger: make(chan struct{}, 1),
+		entries: make(map[string]*evictEntry),
+	}
+}
+
+// SetMaxSize limits the total size of cached artifacts. When usage exceeds
+// high*maxSize, least recently used artifacts are deleted until it falls below
+// low*maxSize. A zero maxSize disables eviction. It must be called before Start.
+func (c *Cache) SetMaxSize(maxSize int64, high, low float64) error {
+	if maxSize <= 0 {
+		c.evictor = nil
+		return nil
+	}
+	if low <= 0 || high > 1 || low >= high {
+		return fmt.Errorf("invalid eviction watermarks %.2f/%.2f (expected 0 < low < high <= 1)", low, high)
+	}
+	c.evictor = newEvictor(c.storage, maxSize, high, low)
+	c.evictor.exempt = c.isHosted
+	return nil
+}
+
+// setLimits changes the size limit of a running evictor, evicting right
+// away if usage is now above the high watermark.
+func (e *evictor) setLimits(maxSize int64, high, low float64) {
+	e.mu.Lock()
+	e.maxSize = maxSize
+	e.high = int64(float64(maxSize) * high)
+	e.low = int64(float64(maxSize) * low)
+	over := e.total > e.high
+	e.mu.Unlock()
+	if over {
+		select {
+		case e.trigger <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// scan indexes the artifacts already stored. Modification time stands in
+// for the last access time of artifacts cached by a previous run.
+func (e *evictor) scan() error {
+	return e.store.List(context.Background(), "/", func(info ObjectInfo) error {
+		if !reservedName(info.Name) && !e.isExempt(info.Name) {
+			e.record(info.Name, info.Size, info.ModTime)
+		}
+		return nil
+	})
+}
+
+func (e *evictor) record(name string, size int64, lastAccess time.Time) {
+	e.mu.Lock()
+	if old, ok := e.entries[name]; ok {
+		e.total -= old.size
+	}
+	e.entries[name] = &evictEntry{size: size, lastAccess: lastAccess}
+	e.total += size
+	total, high := e.total, e.high
+	e.mu.Unlock()
+
+	metrics.CacheSizeBytes.Set(float64(total))
+	if total > high {
+		select {
+		case e.trigger <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (e *evictor) isExempt(name string) bool {
+	return e.exempt != nil && e.exempt(name)
+}
+
+// added records a newly stored artifact.
+func (e *evictor) added(name string) {
+	if e == nil || reservedName(name) {
+		return
+	}
+	info, err := e.store.Stat(context.Background(), name)
+	if err != nil {
+		return
+	}
+	e.record(name, info.Size, time.Now())
+}
+
+// touch marks an artifact as just accessed.
+func (e *evictor) touch(name string) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if entry, ok := e.entries[name]; ok {
+		entry.lastAccess = time.Now()
+	}
+}
+
+// removed forgets an artifact deleted by someone other than the evictor.
+func (e *evictor) removed(name string) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	if entry, ok := e.entries[name]; ok {
+		e.total -= entry.size
+		delete(e.entries, name)
+	}
+	total := e.total
+	e.mu.Unlock()
+	metrics.CacheSizeBytes.Set(float64(total))
+}
+
+func (e *evictor) run() {
+	if err := e.scan(); err != nil {
+		slog.Error("failed to index cache for eviction", "error", err)
+	}
+	e.mu.Lock()
+	slog.Info("cache indexed", "entries", len(e.entries), "size_bytes", e.total, "max_size_bytes", e.maxSize)
+	e.mu.Unlock()
+
+	for range e.trigger {
+		e.evict()
+	}
+}
+
+// evict deletes least recently used artifacts until usage is below the low
+// watermark.
+func (e *evictor) evict() {
+	e.mu.Lock()
+	if e.total <= e.high {
+		e.mu.Unlock()
+		return
+	}
+	type candidate struct {
+		name string
+		evictEntry
+	}
+	candidates := make([]candidate, 0, len(e.entries))
+	for p, entry := range e.entries {
+		if e.isExempt(p) {
+			continue
+		}
+		candidates = append(candidates, candidate{p, *entry})
+	}
+	excess := e.total - e.low
+	e.mu.Unlock()
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].lastAccess.Before(candidates[j].lastAccess)
+	})
+
+	var freed int64
+	var count int
+	for _, cand := range candidates {
+		if freed >= excess {
+			break
+		}
+		e.mu.Lock()
+		entry, ok := e.entries[cand.name]
+		// Skip artifacts touched or replaced since the snapshot was taken.
+		stale := !ok || !entry.lastAccess.Equal(cand.lastAccess)
+		e.mu.Unlock()
+		if stale {
+			continue
+		}
+		ctx := context.Background()
+		if err := e.store.Delete(ctx, cand.name); err != nil {
+			slog.Warn("failed to evict artifact", "artifact", cand.name, "error", err)
+			continue
+		}
+		_ = e.store.Delete(ctx, metaName(cand.name))
+		e.removed(cand.name)
+		freed += cand.size
+		count++
+		metrics.EvictionsTotal.Inc()
+		metrics.EvictedBytesTotal.Add(float64(cand.size))
+	}
+	slog.Info("cache eviction finished", "evicted", count, "freed_bytes", freed)
+}
@@ -0,0 +1,82 @@
+package provider
+
+import (
+	"context"
+	"path"
+	"strings"
+	"sync"
+)
+
+// flightGroup coalesces concurrent upstream fetches of the same artifact, so
+// that background downloads, proxied misses and revalidations of one path
+// share a single upstream transfer.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	done chan struct{}
+	err  error
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{calls: make(map[string]*flightCall)}
+}
+
+// flightKey normalizes an artifact path so that equivalent request paths
+// share a flight.
+func flightKey(name string) string {
+	return path.Clean("/" + strings.TrimPrefix(name, "/"))
+}
+
+// do runs fn for key unless a fetch of key is already in flight, in which
+// case it waits for that fetch and returns its error. leader reports whether
+// fn ran in this call. Waiting stops early when ctx is done.
+func (g *flightGroup) do(ctx context.Context, key string, fn func() error) (err error, leader bool) {
+	g.mu.Lock()
+	if call, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		select {
+		case <-call.done:
+			return call.err, false
+		case <-ctx.Done():
+			return ctx.Err(), false
+		}
+	}
+	call := g.start(key)
+	g.mu.Unlock()
+
+	g.finish(key, call, fn())
+	return call.err, true
+}
+
+// tryDo runs fn for key only if no fetch of key is in flight and reports
+// whether it ran.
+func (g *flightGroup) tryDo(key string, fn func() error) bool {
+	g.mu.Lock()
+	if _, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		return false
+	}
+	call := g.start(key)
+	g.mu.Unlock()
+
+	g.finish(key, call, fn())
+	return true
+}
+
+// start registers a call for key; g.mu must be held.
+func (g *flightGroup) start(key string) *flightCall {
+	call := &flightCall{done: make(chan struct{})}
+	g.calls[key] = call
+	return call
+}
+
+func (g *flightGroup) finish(key string, call *flightCall, err error) {
+	call.err = err
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+	close(call.done)
+}
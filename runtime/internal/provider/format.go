@@ -0,0 +1,178 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"articache/internal/metrics"
+)
+
+// Format is the package ecosystem whose protocol a cache speaks.
+type Format int
+
+const (
+	// FormatMaven serves a Maven repository layout: every request path is
+	// an artifact stored under the same path upstream.
+	FormatMaven Format = iota
+	// FormatNPM serves the npm registry protocol.
+	FormatNPM
+	// FormatGo serves the Go module proxy protocol (GOPROXY).
+	FormatGo
+	// FormatPyPI serves the Python simple repository API (PEP 503/691).
+	FormatPyPI
+	// FormatRaw mirrors an arbitrary file tree, such as a download site,
+	// keeping files only as long as upstream's caching headers allow.
+	FormatRaw
+)
+
+func ParseFormat(format string) (Format, error) {
+	switch strings.ToLower(strings.TrimSpace(format)) {
+	case "", "maven":
+		return FormatMaven, nil
+	case "npm":
+		return FormatNPM, nil
+	case "go":
+		return FormatGo, nil
+	case "pypi":
+		return FormatPyPI, nil
+	case "raw":
+		return FormatRaw, nil
+	default:
+		return FormatMaven, fmt.Errorf("invalid format %q (expected maven, npm, go, pypi or raw)", format)
+	}
+}
+
+func (f Format) String() string {
+	switch f {
+	case FormatNPM:
+		return "npm"
+	case FormatGo:
+		return "go"
+	case FormatPyPI:
+		return "pypi"
+	case FormatRaw:
+		return "raw"
+	default:
+		return "maven"
+	}
+}
+
+// SetFormat selects the protocol the cache speaks. It must be called before
+// the cache starts serving requests.
+func (c *Cache) SetFormat(f Format) {
+	c.format = f
+}
+
+// SetBaseURL sets the URL under which clients reach the cache, for formats
+// whose metadata links back to it. It may be a path such as "/npm", in
+// which case scheme and host are taken from each request. It must be called
+// before the cache starts serving requests.
+func (c *Cache) SetBaseURL(baseURL string) {
+	c.baseURL = strings.TrimRight(baseURL, "/")
+}
+
+// externalURL returns the base URL clients used to reach the cache.
+func (c *Cache) externalURL(r *http.Request) string {
+	if strings.Contains(c.baseURL, "://") {
+		return c.baseURL
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+		scheme = proto
+	}
+	host := r.Host
+	if fwd := r.Header.Get("X-Forwarded-Host"); fwd != "" {
+		host = strings.TrimSpace(strings.Split(fwd, ",")[0])
+	}
+	return scheme + "://" + host + c.baseURL
+}
+
+// artifact describes the download of name from repository, filling in what
+// the format knows about how to fetch and verify it.
+func (c *Cache) artifact(name, repository string) artifactPath {
+	ap := artifactPath{name: name, repository: repository}
+	for _, u := range c.upstreamList() {
+		if u.URL == strings.TrimRight(repository, "/") {
+			ap.credentials = u.Credentials
+			break
+		}
+	}
+	switch c.format {
+	case FormatNPM:
+		c.npmArtifact(&ap)
+	case FormatGo:
+		c.goArtifact(&ap)
+	case FormatPyPI:
+		c.pypiArtifact(&ap)
+	}
+	return ap
+}
+
+// errNotListed is returned for files of formats that publish their digests
+// in an index, when the index does not list them and they cannot be verified.
+var errNotListed = errors.New("not listed in the package index")
+
+// verifiable makes sure the digest of ap is known before it is downloaded, or
+// a client is redirected to it, for formats that publish digests in an index.
+func (c *Cache) verifiable(ctx context.Context, ap *artifactPath) error {
+	switch c.format {
+	case FormatNPM:
+		return c.npmVerifiable(ctx, ap)
+	case FormatPyPI:
+		return c.pypiVerifiable(ctx, ap)
+	}
+	return nil
+}
+
+// classify returns the path class of name in the cache's format.
+func (c *Cache) classify(name string) PathClass {
+	switch c.format {
+	case FormatNPM:
+		return npmClassify(name)
+	case FormatGo:
+		return goClassify(name)
+	case FormatPyPI:
+		return pypiClassify(name)
+	case FormatRaw:
+		return ClassUpstream
+	default:
+		return classify(name)
+	}
+}
+
+// fetchMetadata downloads a missing metadata document, such as an npm
+// packument, while the client waits, since a redirect would hand the client
+// links that bypass the cache. On failure it returns the status to answer
+// with.
+func (c *Cache) fetchMetadata(ctx context.Context, name string) (int, error) {
+	if c.knownMissing(name) {
+		metrics.HTTPRequestsTotal.WithLabelValues("not_found").Inc()
+		metrics.NegativeCacheHitsTotal.Inc()
+		return http.StatusNotFound, ErrNotFound
+	}
+	metrics.HTTPRequestsTotal.WithLabelValues("miss").Inc()
+	metrics.CacheMissesTotal.Inc()
+	err, leader := c.flights.do(ctx, flightKey(name), func() error {
+		metrics.DownloadsInflight.Inc()
+		defer metrics.DownloadsInflight.Dec()
+		return c.download(context.WithoutCancel(ctx), artifactPath{name: name})
+	})
+	if !leader {
+		metrics.CoalescedRequestsTotal.Inc()
+	}
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound, err
+	case errors.Is(err, errCircuitOpen):
+		return http.StatusServiceUnavailable, err
+	case err != nil:
+		return http.StatusBadGateway, err
+	}
+	return http.StatusOK, nil
+}
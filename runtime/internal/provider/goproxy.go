@@ -0,0 +1,284 @@
+package provider
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// goSemver matches canonical semantic versions, pseudo-versions included.
+// Files of such versions never change; anything else in a version position
+// is a query such as a branch name.
+var goSemver = regexp.MustCompile(`^v[0-9]+\.[0-9]+\.[0-9]+(-[0-9A-Za-z.-]+)?(\+[0-9A-Za-z.-]+)?$`)
+
+// goRequest is a parsed Go module proxy request.
+type goRequest struct {
+	module  string // decoded module path
+	version string // decoded version; empty for list and @latest
+	file    string // "list", "latest", "info", "mod" or "zip"
+}
+
+// parseGoPath parses a module proxy path such as
+// "/github.com/!azure/sdk/@v/v1.2.3.zip". Module paths and versions are
+// case-encoded: an upper-case letter is sent as '!' and its lower-case form.
+func parseGoPath(p string) (goRequest, error) {
+	var req goRequest
+	escModule, rest, ok := strings.Cut(strings.TrimPrefix(p, "/"), "/@")
+	if !ok || escModule == "" {
+		return req, fmt.Errorf("invalid module proxy path %q", p)
+	}
+	var escVersion string
+	switch {
+	case rest == "latest":
+		req.file = "latest"
+	case rest == "v/list":
+		req.file = "list"
+	case strings.HasPrefix(rest, "v/"):
+		name := strings.TrimPrefix(rest, "v/")
+		dot := strings.LastIndex(name, ".")
+		if dot <= 0 || strings.Contains(name, "/") {
+			return req, fmt.Errorf("invalid module proxy path %q", p)
+		}
+		escVersion, req.file = name[:dot], name[dot+1:]
+		if req.file != "info" && req.file != "mod" && req.file != "zip" {
+			return req, fmt.Errorf("invalid module proxy path %q", p)
+		}
+	default:
+		return req, fmt.Errorf("invalid module proxy path %q", p)
+	}
+
+	var err error
+	if req.module, err = goUnescape(escModule); err != nil {
+		return req, err
+	}
+	if err := checkModulePath(req.module); err != nil {
+		return req, err
+	}
+	if escVersion != "" {
+		if req.version, err = goUnescape(escVersion); err != nil {
+			return req, err
+		}
+		// .mod and .zip are only served for canonical versions.
+		if req.file != "info" && !goSemver.MatchString(req.version) {
+			return req, fmt.Errorf("invalid module version %q", req.version)
+		}
+	}
+	return req, nil
+}
+
+// goUnescape reverses the module proxy's case-encoding.
+func goUnescape(s string) (string, error) {
+	var b strings.Builder
+	bang := false
+	for _, r := range s {
+		switch {
+		case bang:
+			if r < 'a' || r > 'z' {
+				return "", fmt.Errorf("invalid escaped path %q", s)
+			}
+			b.WriteRune(r - 'a' + 'A')
+			bang = false
+		case r == '!':
+			bang = true
+		case r >= 'A' && r <= 'Z':
+			return "", fmt.Errorf("invalid escaped path %q: upper-case letters must be escaped", s)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	if bang {
+		return "", fmt.Errorf("invalid escaped path %q", s)
+	}
+	return b.String(), nil
+}
+
+// goEscape case-encodes a module path or version.
+func goEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if r >= 'A' && r <= 'Z' {
+			b.WriteByte('!')
+			r += 'a' - 'A'
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// checkModulePath applies the module path rules that matter for storing and
+// forwarding a path: slash-separated, non-empty elements of safe characters
+// that do not start or end with a dot.
+func checkModulePath(module string) error {
+	for _, elem := range strings.Split(module, "/") {
+		if elem == "" || strings.HasPrefix(elem, ".") || strings.HasSuffix(elem, ".") {
+			return fmt.Errorf("invalid module path %q", module)
+		}
+		for _, r := range elem {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-._~", r)) {
+				return fmt.Errorf("invalid module path %q", module)
+			}
+		}
+	}
+	return nil
+}
+
+// goClassify treats version lists, @latest and version queries as metadata
+// and the files of canonical versions as immutable releases.
+func goClassify(name string) PathClass {
+	req, err := parseGoPath(name)
+	if err != nil || req.file == "list" || req.file == "latest" || !goSemver.MatchString(req.version) {
+		return ClassMetadata
+	}
+	return ClassRelease
+}
+
+// SetSumDB makes the cache verify downloaded .mod and .zip files against the
+// hashes a checksum database at sumdbURL publishes, e.g.
+// https://sum.golang.org or a mirror of it. The database is trusted as is:
+// its transparency log proofs are left to clients. An empty URL disables
+// verification. It must be called before Start.
+func (c *Cache) SetSumDB(sumdbURL string) {
+	c.sumdb = nil
+	if sumdbURL != "" {
+		c.sumdb = &sumDB{url: strings.TrimRight(sumdbURL, "/"), httpClient: &http.Client{Timeout: 30 * time.Second}}
+	}
+}
+
+// goArtifact arranges for .mod and .zip downloads to be checked against the
+// checksum database. Other files carry no published hash.
+func (c *Cache) goArtifact(ap *artifactPath) {
+	req, err := parseGoPath(ap.name)
+	if err != nil || c.sumdb == nil || (req.file != "mod" && req.file != "zip") {
+		ap.unverified = true
+		return
+	}
+	ap.verifyFile = func(ctx context.Context, f *os.File) error {
+		want, err := c.sumdb.lookup(ctx, req.module, req.version, req.file == "mod")
+		if err != nil {
+			return err
+		}
+		var got string
+		if req.file == "mod" {
+			got, err = hashGoMod(f)
+		} else {
+			got, err = hashGoZip(f)
+		}
+		if err != nil {
+			return fmt.Errorf("hash %s@%s: %w", req.module, req.version, err)
+		}
+		if got != want {
+			return &checksumError{url: ap.url(), algorithm: "h1", expected: want, actual: got}
+		}
+		return nil
+	}
+}
+
+// sumDB looks up module hashes in a Go checksum database.
+type sumDB struct {
+	url        string
+	httpClient *http.Client
+}
+
+// lookup returns the go.sum hash of a module version's zip, or of its
+// go.mod file when goMod is set.
+func (s *sumDB) lookup(ctx context.Context, module, version string, goMod bool) (string, error) {
+	lookupURL := s.url + "/lookup/" + goEscape(module) + "@" + goEscape(version)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, lookupURL, nil)
+	if err != nil {
+		return "", fmt.Errorf("create request: %w", err)
+	}
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("lookup %q: %w", lookupURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return "", fmt.Errorf("lookup %q: unexpected status %d", lookupURL, resp.StatusCode)
+	}
+
+	// The record lists "<module> <version> <hash>" and
+	// "<module> <version>/go.mod <hash>" lines.
+	wantVersion := version
+	if goMod {
+		wantVersion += "/go.mod"
+	}
+	scanner := bufio.NewScanner(io.LimitReader(resp.Body, 64<<10))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 3 && fields[0] == module && fields[1] == wantVersion {
+			return fields[2], nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("read %q: %w", lookupURL, err)
+	}
+	return "", fmt.Errorf("lookup %q: no hash for %s %s", lookupURL, module, wantVersion)
+}
+
+// hashGoMod computes the go.sum hash of a go.mod file.
+func hashGoMod(f *os.File) (string, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return hash1([]string{"go.mod"}, func(string) (io.ReadCloser, error) {
+		return io.NopCloser(f), nil
+	})
+}
+
+// hashGoZip computes the go.sum hash of a module zip.
+func hashGoZip(f *os.File) (string, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	z, err := zip.NewReader(f, info.Size())
+	if err != nil {
+		return "", err
+	}
+	files := make(map[string]*zip.File, len(z.File))
+	names := make([]string, 0, len(z.File))
+	for _, zf := range z.File {
+		files[zf.Name] = zf
+		names = append(names, zf.Name)
+	}
+	return hash1(names, func(name string) (io.ReadCloser, error) {
+		return files[name].Open()
+	})
+}
+
+// hash1 implements the "h1:" directory hash of go.sum: the SHA-256 of a
+// summary listing the SHA-256 of every file, sorted by name.
+func hash1(names []string, open func(string) (io.ReadCloser, error)) (string, error) {
+	sorted := append([]string(nil), names...)
+	sort.Strings(sorted)
+	summary := sha256.New()
+	for _, name := range sorted {
+		if strings.Contains(name, "\n") {
+			return "", errors.New("file names with newlines are not supported")
+		}
+		r, err := open(name)
+		if err != nil {
+			return "", err
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, r)
+		r.Close()
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(summary, "%x  %s\n", h.Sum(nil), name)
+	}
+	return "h1:" + base64.StdEncoding.EncodeToString(summary.Sum(nil)), nil
+}
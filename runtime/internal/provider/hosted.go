@@ -0,0 +1,246 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"articache/internal/metrics"
+)
+
+// maxChecksumFileSize bounds the checksum files accepted by uploads; they
+// hold a hex digest and at most a file name.
+const maxChecksumFileSize = 1 << 10
+
+// SetHosted sets the path prefixes of the Maven repositories the cache hosts
+// itself. Artifacts below them are uploaded by clients instead of fetched
+// upstream, and are never revalidated or evicted.
+func (c *Cache) SetHosted(prefixes []string) {
+	list := make([]string, len(prefixes))
+	for i, prefix := range prefixes {
+		list[i] = strings.TrimRight(prefix, "/")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.hosted = list
+}
+
+// isHosted reports whether name lies below a hosted prefix.
+func (c *Cache) isHosted(name string) bool {
+	if c.format != FormatMaven {
+		return false
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, prefix := range c.hosted {
+		if prefix == "" || name == prefix || strings.HasPrefix(name, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func validateHosted(prefixes []string) error {
+	for _, prefix := range prefixes {
+		if !strings.HasPrefix(prefix, "/") {
+			return fmt.Errorf("invalid hosted prefix %q (expected an absolute path)", prefix)
+		}
+	}
+	return nil
+}
+
+// uploadError is an upload refused with an HTTP status.
+type uploadError struct {
+	status int
+	msg    string
+}
+
+func (e *uploadError) Error() string { return e.msg }
+
+// handleUpload answers a PUT of an artifact to a hosted prefix.
+func (c *Cache) handleUpload(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	file, err := artifactName(r.URL.Path)
+	if err != nil {
+		err = &uploadError{http.StatusBadRequest, "invalid artifact path"}
+	} else {
+		err = c.upload(r.Context(), file, r.Body)
+	}
+	status := http.StatusCreated
+	var refused *uploadError
+	switch {
+	case errors.As(err, &refused):
+		status = refused.status
+		if status == http.StatusMethodNotAllowed {
+			w.Header().Set("Allow", "GET, HEAD")
+		}
+		http.Error(w, refused.msg, status)
+	case err != nil:
+		status = http.StatusInternalServerError
+		http.Error(w, "failed to store artifact", status)
+	default:
+		w.WriteHeader(status)
+	}
+	metrics.HTTPRequestsTotal.WithLabelValues("upload").Inc()
+	switch {
+	case refused != nil:
+		slog.Info("artifact upload refused", "path", r.URL.Path, "status", status, "remote_addr", r.RemoteAddr, "reason", refused.msg)
+	case err != nil:
+		slog.Error("artifact upload", "path", r.URL.Path, "status", status, "remote_addr", r.RemoteAddr, "error", err)
+	default:
+		slog.Info("artifact upload", "path", file, "status", status, "remote_addr", r.RemoteAddr, "duration_ms", time.Since(start).Milliseconds())
+	}
+}
+
+// upload stores body as the hosted artifact name. Release artifacts cannot be
+// replaced once a checksum file confirmed them; snapshots and
+// maven-metadata.xml files can. Checksum files are checked against the
+// artifact uploaded before them. When they disagree the checksum file is
+// refused, and a snapshot or unconfirmed release artifact is removed again.
+func (c *Cache) upload(ctx context.Context, name string, body io.Reader) error {
+	if !c.isHosted(name) {
+		return &uploadError{http.StatusMethodNotAllowed, "uploads are only accepted below hosted prefixes"}
+	}
+	target, alg := name, ""
+	for _, a := range checksumAlgorithms {
+		if base, ok := strings.CutSuffix(name, "."+a.ext); ok {
+			target, alg = base, a.ext
+			break
+		}
+	}
+	release := c.classify(target) == ClassRelease
+	store := c.storage.Put
+	if release {
+		// Refuse early, before reading the body; create settles races.
+		if alg != "" {
+			if _, err := c.storage.Stat(ctx, name); err == nil {
+				return errRedeploy
+			} else if !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+		} else if err := c.removeUnconfirmed(ctx, name); err != nil {
+			return err
+		}
+		store = c.create
+	}
+	if alg != "" {
+		return c.uploadChecksum(ctx, name, target, alg, body, release, store)
+	}
+
+	hw := newHashingWriter()
+	if err := store(ctx, name, io.TeeReader(body, hw)); errors.Is(err, fs.ErrExist) {
+		return errRedeploy
+	} else if err != nil {
+		return fmt.Errorf("store %q: %w", name, err)
+	}
+	checksums := make(map[string]string, len(checksumAlgorithms))
+	for _, a := range checksumAlgorithms {
+		checksums[a.ext] = hw.sum(a.ext)
+	}
+	if err := writeMeta(ctx, c.storage, name, entryMeta{FetchedAt: time.Now(), Checksums: checksums, Unconfirmed: release}); err != nil {
+		slog.Warn("failed to write artifact metadata", "artifact", name, "error", err)
+	}
+	return nil
+}
+
+// removeUnconfirmed makes way for a new deploy of the release artifact name
+// by removing a copy no checksum file has confirmed. A confirmed copy, or one
+// whose upload is still being recorded, refuses the deploy.
+func (c *Cache) removeUnconfirmed(ctx context.Context, name string) error {
+	c.deploys.Lock()
+	defer c.deploys.Unlock()
+	if _, err := c.storage.Stat(ctx, name); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	meta, err := readMeta(ctx, c.storage, name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err != nil || !meta.Unconfirmed {
+		return errRedeploy
+	}
+	c.removeDeployed(ctx, name)
+	return nil
+}
+
+// removeDeployed deletes the hosted artifact name and its metadata.
+func (c *Cache) removeDeployed(ctx context.Context, name string) {
+	for _, n := range []string{name, metaName(name)} {
+		if err := c.storage.Delete(ctx, n); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			slog.Warn("failed to remove deployed artifact", "artifact", n, "error", err)
+		}
+	}
+}
+
+// errRedeploy refuses uploads over a release artifact.
+var errRedeploy = &uploadError{http.StatusConflict, "release artifacts cannot be redeployed"}
+
+// create stores r under name unless an object exists there, in a single step
+// when the storage supports it.
+func (c *Cache) create(ctx context.Context, name string, r io.Reader) error {
+	if cr, ok := c.storage.(Creator); ok {
+		return cr.Create(ctx, name, r)
+	}
+	if _, err := c.storage.Stat(ctx, name); err == nil {
+		return fmt.Errorf("create %q: %w", name, fs.ErrExist)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return c.storage.Put(ctx, name, r)
+}
+
+// uploadChecksum stores the checksum file name with store after comparing it
+// with the alg digest recorded when target was uploaded. A matching checksum
+// confirms a release artifact.
+func (c *Cache) uploadChecksum(ctx context.Context, name, target, alg string, body io.Reader, release bool, store func(context.Context, string, io.Reader) error) error {
+	data, err := io.ReadAll(io.LimitReader(body, maxChecksumFileSize+1))
+	if err != nil {
+		return fmt.Errorf("read %q: %w", name, err)
+	}
+	if len(data) > maxChecksumFileSize {
+		return &uploadError{http.StatusBadRequest, "checksum file too large"}
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return &uploadError{http.StatusBadRequest, "empty checksum file"}
+	}
+	c.deploys.Lock()
+	defer c.deploys.Unlock()
+	meta, err := readMeta(ctx, c.storage, target)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &uploadError{http.StatusConflict, "checksum uploaded before the artifact it belongs to"}
+	}
+	if err != nil {
+		return err
+	}
+	if expected := meta.Checksums[alg]; !strings.EqualFold(fields[0], expected) {
+		// A confirmed release stays, or anyone could remove it and deploy
+		// it again.
+		if release && !meta.Unconfirmed {
+			return &uploadError{http.StatusBadRequest, fmt.Sprintf("%s checksum mismatch for %s: checksum refused", alg, target)}
+		}
+		// Leave nothing behind that does not match what the client built.
+		c.removeDeployed(ctx, target)
+		return &uploadError{http.StatusBadRequest, fmt.Sprintf("%s checksum mismatch for %s: artifact removed", alg, target)}
+	}
+	if err := store(ctx, name, strings.NewReader(string(data))); errors.Is(err, fs.ErrExist) {
+		return errRedeploy
+	} else if err != nil {
+		return fmt.Errorf("store %q: %w", name, err)
+	}
+	if meta.Unconfirmed {
+		meta.Unconfirmed = false
+		if err := writeMeta(ctx, c.storage, target, meta); err != nil {
+			return fmt.Errorf("confirm %q: %w", target, err)
+		}
+	}
+	return nil
+}
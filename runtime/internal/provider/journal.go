@@ -0,0 +1,357 @@
+package provider
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"articache/internal/metrics"
+)
+
+// journalCompactSize is how much of the download journal may be read before it
+// is rewritten without the downloads that have finished.
+const journalCompactSize = 1 << 20
+
+// handoffSize is how many downloads read from the journal are held in memory,
+// ready for the next free worker. The rest wait in the journal.
+const handoffSize = 64
+
+// errCoalesced is the outcome of a journaled download skipped because the
+// artifact was already being fetched. That fetch may still fail, so the
+// download stays in the journal.
+var errCoalesced = errors.New("download already in flight")
+
+// journalRecord is a line of the download journal: a queued download, or the
+// end of one. Job names the prefetch job a download was queued for; jobs are
+// not kept across restarts, so resumed downloads run without one.
+type journalRecord struct {
+	Done       bool   `json:"done,omitempty"`
+	Name       string `json:"name"`
+	Repository string `json:"repository,omitempty"`
+	Job        string `json:"job,omitempty"`
+}
+
+func (rec journalRecord) key() string {
+	return rec.Repository + rec.Name
+}
+
+// downloadJournal is the queue of background downloads, kept in an
+// append-only file under the cache path so that its size is bounded by disk
+// space and downloads left pending or failed are resumed after a restart.
+// Records are not synced to disk one by one; a crash of the machine, rather
+// than of articache, may lose the last few.
+type downloadJournal struct {
+	mu   sync.Mutex
+	path string
+	w    *os.File
+	r    *bufio.Reader
+	rf   *os.File
+	// read is how far the journal has been read, and kept how much of that
+	// the last compaction kept.
+	read int64
+	kept int64
+	// pending counts queued downloads not yet handed to a worker, and
+	// inflight those handed out and not finished. running holds the latter
+	// by key, with how many times each was handed out.
+	pending  int
+	inflight int
+	running  map[string]runningDownload
+	// failed holds downloads that failed. They stay in the journal, across
+	// compactions, to be retried after a restart.
+	failed map[string]journalRecord
+	wake   chan struct{}
+}
+
+type runningDownload struct {
+	rec journalRecord
+	n   int
+}
+
+// openJournal opens the journal at path and replays it: downloads queued but
+// not finished before are queued again, in their original order.
+func openJournal(path string) (*downloadJournal, error) {
+	j := &downloadJournal{
+		path:    path,
+		running: make(map[string]runningDownload),
+		failed:  make(map[string]journalRecord),
+		wake:    make(chan struct{}, 1),
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("mkdir %q: %w", filepath.Dir(path), err)
+	}
+	var order []string
+	queued := make(map[string]journalRecord)
+	if f, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var rec journalRecord
+			if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+				// A record torn by a crash; the rest of the journal is intact.
+				continue
+			}
+			if rec.Done {
+				delete(queued, rec.key())
+				continue
+			}
+			if _, ok := queued[rec.key()]; !ok {
+				order = append(order, rec.key())
+			}
+			queued[rec.key()] = rec
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("read %q: %w", path, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	var records []journalRecord
+	for _, key := range order {
+		if rec, ok := queued[key]; ok {
+			records = append(records, rec)
+		}
+	}
+	data, err := encodeRecords(records)
+	if err != nil {
+		return nil, err
+	}
+	if err := j.rewrite(nil, data); err != nil {
+		return nil, err
+	}
+	j.pending = len(records)
+	if j.pending > 0 {
+		slog.Info("resuming queued downloads", "journal", path, "downloads", j.pending)
+	}
+	return j, nil
+}
+
+func encodeRecords(records []journalRecord) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, rec := range records {
+		if err := enc.Encode(rec); err != nil {
+			return nil, fmt.Errorf("encode journal record: %w", err)
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// rewrite replaces the journal with the records consumed followed by the
+// encoded records unread. The reader starts after the consumed records, so
+// that they are read again only after a restart. It is called with mu held or
+// before the journal is shared.
+func (j *downloadJournal) rewrite(consumed []journalRecord, unread []byte) error {
+	head, err := encodeRecords(consumed)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(j.path, append(head, unread...)); err != nil {
+		return err
+	}
+	if j.w != nil {
+		_ = j.w.Close()
+		_ = j.rf.Close()
+	}
+	w, err := os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("open %q: %w", j.path, err)
+	}
+	rf, err := os.Open(j.path)
+	if err != nil {
+		_ = w.Close()
+		return fmt.Errorf("open %q: %w", j.path, err)
+	}
+	if _, err := rf.Seek(int64(len(head)), io.SeekStart); err != nil {
+		_ = w.Close()
+		_ = rf.Close()
+		return fmt.Errorf("seek %q: %w", j.path, err)
+	}
+	j.w, j.rf, j.r = w, rf, bufio.NewReader(rf)
+	j.read, j.kept = int64(len(head)), int64(len(head))
+	return nil
+}
+
+func (j *downloadJournal) append(rec journalRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("encode journal record: %w", err)
+	}
+	if _, err := j.w.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("write %q: %w", j.path, err)
+	}
+	return nil
+}
+
+func (j *downloadJournal) signal() {
+	select {
+	case j.wake <- struct{}{}:
+	default:
+	}
+}
+
+// add queues the download described by rec.
+func (j *downloadJournal) add(rec journalRecord) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := j.append(rec); err != nil {
+		return err
+	}
+	j.pending++
+	j.signal()
+	return nil
+}
+
+// next returns the oldest queued download not yet handed out, waiting for
+// one to be queued when there is none.
+func (j *downloadJournal) next() journalRecord {
+	for {
+		j.mu.Lock()
+		for {
+			if j.read-j.kept > journalCompactSize {
+				j.compact()
+			}
+			line, err := j.r.ReadBytes('\n')
+			if err != nil {
+				// Records are written whole under mu, so only the end of
+				// the journal is reached here.
+				break
+			}
+			j.read += int64(len(line))
+			var rec journalRecord
+			if json.Unmarshal(line, &rec) != nil || rec.Done {
+				continue
+			}
+			j.pending--
+			j.inflight++
+			run := j.running[rec.key()]
+			run.rec, run.n = rec, run.n+1
+			j.running[rec.key()] = run
+			j.mu.Unlock()
+			return rec
+		}
+		j.mu.Unlock()
+		<-j.wake
+	}
+}
+
+// compact rewrites the journal without the downloads that have finished. The
+// ones that failed or are still running are kept, ahead of the reader so
+// that they are handed out again only after a restart, followed by the
+// downloads queued and not read yet. It is called with mu held.
+func (j *downloadJournal) compact() {
+	data, err := os.ReadFile(j.path)
+	if err == nil && int64(len(data)) < j.read {
+		err = fmt.Errorf("journal shorter than the %d bytes read", j.read)
+	}
+	if err != nil {
+		slog.Warn("failed to compact download journal", "journal", j.path, "error", err)
+		return
+	}
+	records := make([]journalRecord, 0, len(j.running)+len(j.failed))
+	for _, run := range j.running {
+		records = append(records, run.rec)
+	}
+	for key, rec := range j.failed {
+		if _, ok := j.running[key]; !ok {
+			records = append(records, rec)
+		}
+	}
+	// An end recorded after the reader belongs to a download read before it,
+	// which is either dropped here or still kept.
+	var unread []byte
+	for line := range bytes.Lines(data[j.read:]) {
+		var rec journalRecord
+		if json.Unmarshal(line, &rec) == nil && !rec.Done {
+			unread = append(unread, line...)
+		}
+	}
+	if err := j.rewrite(records, unread); err != nil {
+		slog.Warn("failed to compact download journal", "journal", j.path, "error", err)
+		// Retry once as much again has been read.
+		j.kept = j.read
+	}
+}
+
+// finish records the outcome of a download handed out by next. Downloads
+// that failed for reasons other than the artifact missing upstream stay in
+// the journal.
+func (j *downloadJournal) finish(rec journalRecord, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.inflight--
+	if run := j.running[rec.key()]; run.n > 1 {
+		run.n--
+		j.running[rec.key()] = run
+	} else {
+		delete(j.running, rec.key())
+	}
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		j.failed[rec.key()] = rec
+	} else {
+		delete(j.failed, rec.key())
+		done := rec
+		done.Done = true
+		if err := j.append(done); err != nil {
+			slog.Warn("failed to record finished download", "journal", j.path, "artifact", rec.Name, "error", err)
+		}
+	}
+	if j.inflight == 0 {
+		j.signal()
+	}
+}
+
+// depth returns how many queued downloads wait for a worker.
+func (j *downloadJournal) depth() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.pending
+}
+
+// feedLoop hands the downloads queued in the journal to the workers as they
+// become free. Artifacts cached in the meantime, and those whose upstream is
+// no longer routed to them, are skipped.
+func (c *Cache) feedLoop() {
+	for {
+		rec := c.journal.next()
+		ap := artifactPath{name: rec.Name, journaled: true}
+		if rec.Repository != "" {
+			ap = c.artifact(rec.Name, rec.Repository)
+			ap.journaled = true
+		}
+		if rec.Job != "" {
+			ap.job, _ = c.jobs.get(rec.Job)
+		}
+		if _, ok := c.lookup(context.Background(), rec.Name); ok {
+			if ap.job != nil {
+				ap.job.markCached(rec.Name)
+			}
+			c.journal.finish(rec, nil)
+			continue
+		}
+		if ap.repository != "" && !c.routed(ap) {
+			c.journal.finish(rec, nil)
+			continue
+		}
+		c.handoff <- ap
+		metrics.DownloadQueueDepth.Set(float64(c.queueDepth()))
+	}
+}
+
+// queueDepth returns how many background downloads wait for a worker.
+func (c *Cache) queueDepth() int {
+	n := len(c.queue) + len(c.handoff)
+	if c.journal != nil {
+		n += c.journal.depth()
+	}
+	return n
+}
@@ -0,0 +1,186 @@
+package provider
+
+import (
+	"encoding/xml"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Coordinate identifies a Maven artifact.
+type Coordinate struct {
+	GroupID    string
+	ArtifactID string
+	Version    string
+	Classifier string
+	Extension  string
+}
+
+// ParseCoordinate parses "group:artifact:version[:classifier][@ext]". The
+// extension defaults to jar.
+func ParseCoordinate(s string) (Coordinate, error) {
+	s = strings.TrimSpace(s)
+	rest, ext, hasExt := strings.Cut(s, "@")
+	parts := strings.Split(rest, ":")
+	if len(parts) < 3 || len(parts) > 4 || (hasExt && ext == "") {
+		return Coordinate{}, fmt.Errorf("invalid coordinate %q (expected group:artifact:version[:classifier][@ext])", s)
+	}
+	c := Coordinate{GroupID: parts[0], ArtifactID: parts[1], Version: parts[2], Extension: "jar"}
+	if len(parts) == 4 {
+		c.Classifier = parts[3]
+	}
+	if hasExt {
+		c.Extension = ext
+	}
+	if err := c.validate(); err != nil {
+		return Coordinate{}, err
+	}
+	return c, nil
+}
+
+func (c Coordinate) validate() error {
+	for _, field := range []string{c.GroupID, c.ArtifactID, c.Version, c.Extension} {
+		if field == "" {
+			return fmt.Errorf("invalid coordinate %q: empty field", c)
+		}
+	}
+	for _, field := range []string{c.GroupID, c.ArtifactID, c.Version, c.Classifier, c.Extension} {
+		if strings.ContainsAny(field, "/\\") || field == "." || field == ".." || strings.Contains(field, "${") {
+			return fmt.Errorf("invalid coordinate %q", c)
+		}
+	}
+	return nil
+}
+
+func (c Coordinate) String() string {
+	s := c.GroupID + ":" + c.ArtifactID + ":" + c.Version
+	if c.Classifier != "" {
+		s += ":" + c.Classifier
+	}
+	if c.Extension != "" && c.Extension != "jar" {
+		s += "@" + c.Extension
+	}
+	return s
+}
+
+// Path returns the repository path of the artifact.
+func (c Coordinate) Path() string {
+	file := c.ArtifactID + "-" + c.Version
+	if c.Classifier != "" {
+		file += "-" + c.Classifier
+	}
+	return c.dir() + "/" + file + "." + c.Extension
+}
+
+// POMPath returns the repository path of the artifact's POM.
+func (c Coordinate) POMPath() string {
+	return c.dir() + "/" + c.ArtifactID + "-" + c.Version + ".pom"
+}
+
+func (c Coordinate) dir() string {
+	return "/" + strings.ReplaceAll(c.GroupID, ".", "/") + "/" + c.ArtifactID + "/" + c.Version
+}
+
+type pom struct {
+	GroupID    string `xml:"groupId"`
+	ArtifactID string `xml:"artifactId"`
+	Version    string `xml:"version"`
+	Parent     struct {
+		GroupID    string `xml:"groupId"`
+		ArtifactID string `xml:"artifactId"`
+		Version    string `xml:"version"`
+	} `xml:"parent"`
+	Properties struct {
+		Entries []struct {
+			XMLName xml.Name
+			Value   string `xml:",chardata"`
+		} `xml:",any"`
+	} `xml:"properties"`
+	Dependencies         []pomDependency `xml:"dependencies>dependency"`
+	DependencyManagement []pomDependency `xml:"dependencyManagement>dependencies>dependency"`
+}
+
+type pomDependency struct {
+	GroupID    string `xml:"groupId"`
+	ArtifactID string `xml:"artifactId"`
+	Version    string `xml:"version"`
+	Classifier string `xml:"classifier"`
+	Type       string `xml:"type"`
+}
+
+var pomPropertyRef = regexp.MustCompile(`\$\{([^}]+)\}`)
+
+// ParsePOM returns the artifacts a POM refers to: its parent, its
+// dependencies and, for BOMs, its managed dependencies. Property references
+// are expanded from the POM's own properties. Dependencies whose version
+// cannot be determined from the POM alone are reported in unresolved.
+func ParsePOM(data []byte) (coords []Coordinate, unresolved []string, err error) {
+	var p pom
+	if err := xml.Unmarshal(data, &p); err != nil {
+		return nil, nil, fmt.Errorf("parse pom: %w", err)
+	}
+
+	props := map[string]string{}
+	for _, e := range p.Properties.Entries {
+		props[e.XMLName.Local] = strings.TrimSpace(e.Value)
+	}
+	groupID, version := p.GroupID, p.Version
+	if groupID == "" {
+		groupID = p.Parent.GroupID
+	}
+	if version == "" {
+		version = p.Parent.Version
+	}
+	for _, prefix := range []string{"project.", "pom.", ""} {
+		props[prefix+"groupId"] = groupID
+		props[prefix+"artifactId"] = p.ArtifactID
+		props[prefix+"version"] = version
+	}
+	props["project.parent.version"] = p.Parent.Version
+	props["project.parent.groupId"] = p.Parent.GroupID
+
+	expand := func(s string) string {
+		s = strings.TrimSpace(s)
+		// Properties may refer to other properties; a few rounds suffice.
+		for i := 0; i < 5 && strings.Contains(s, "${"); i++ {
+			s = pomPropertyRef.ReplaceAllStringFunc(s, func(ref string) string {
+				if v, ok := props[ref[2:len(ref)-1]]; ok {
+					return v
+				}
+				return ref
+			})
+		}
+		return s
+	}
+
+	if p.Parent.GroupID != "" && p.Parent.ArtifactID != "" && p.Parent.Version != "" {
+		coords = append(coords, Coordinate{
+			GroupID:    expand(p.Parent.GroupID),
+			ArtifactID: expand(p.Parent.ArtifactID),
+			Version:    expand(p.Parent.Version),
+			Extension:  "pom",
+		})
+	}
+	for _, dep := range append(p.DependencyManagement, p.Dependencies...) {
+		c := Coordinate{
+			GroupID:    expand(dep.GroupID),
+			ArtifactID: expand(dep.ArtifactID),
+			Version:    expand(dep.Version),
+			Classifier: expand(dep.Classifier),
+			Extension:  "jar",
+		}
+		switch t := expand(dep.Type); t {
+		case "", "jar", "bundle", "maven-plugin":
+		case "test-jar":
+			c.Classifier = "tests"
+		default:
+			c.Extension = t
+		}
+		if c.validate() != nil {
+			unresolved = append(unresolved, c.String())
+			continue
+		}
+		coords = append(coords, c)
+	}
+	return coords, unresolved, nil
+}
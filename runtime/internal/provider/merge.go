@@ -0,0 +1,375 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"articache/internal/metrics"
+)
+
+// mavenMetadataFile is the version index Maven keeps for every artifact.
+const mavenMetadataFile = "maven-metadata.xml"
+
+// mergedDocument returns the maven-metadata.xml that name is, or is a
+// checksum file of, when that document is merged from several upstreams: in
+// a Maven cache, outside hosted prefixes, with more than one upstream routed
+// to it.
+func (c *Cache) mergedDocument(name string) (string, bool) {
+	if c.format != FormatMaven {
+		return "", false
+	}
+	doc := name
+	for _, alg := range checksumAlgorithms {
+		if base, ok := strings.CutSuffix(name, "."+alg.ext); ok {
+			doc = base
+			break
+		}
+	}
+	if path.Base(doc) != mavenMetadataFile || c.isHosted(doc) {
+		return "", false
+	}
+	routed := 0
+	for _, u := range c.upstreamList() {
+		if u.Allows(doc) {
+			routed++
+		}
+	}
+	return doc, routed > 1
+}
+
+// mergeStageName returns where the copy of the document name fetched from
+// upstream u is kept between merges. Copies are keyed by the upstream's URL,
+// as upstreams on one host share the default name.
+func mergeStageName(u Upstream, name string) string {
+	sum := sha256.Sum256([]byte(u.URL))
+	return "/" + metaDirName + "/merge/" + hex.EncodeToString(sum[:8]) + name
+}
+
+// handleMavenMetadata answers requests for merged maven-metadata.xml files
+// and their checksums. Merged documents are always served by the cache, even
+// in redirect mode, as no single upstream has them. It reports false for
+// other paths.
+func (c *Cache) handleMavenMetadata(w http.ResponseWriter, r *http.Request) bool {
+	start := time.Now()
+	file, err := artifactName(r.URL.Path)
+	if err != nil {
+		return false
+	}
+	doc, ok := c.mergedDocument(file)
+	if !ok {
+		return false
+	}
+
+	result := "hit"
+	_, cached := c.lookup(r.Context(), file)
+	if cached {
+		metrics.HTTPRequestsTotal.WithLabelValues("hit").Inc()
+		metrics.CacheHitsTotal.Inc()
+		c.revalidateIfStale(r.Context(), doc)
+	} else {
+		result = "miss"
+		status, err := c.fetchMetadata(r.Context(), doc)
+		if err != nil {
+			http.Error(w, http.StatusText(status), status)
+			slog.Info("artifact request", "result", result, "path", file, "status", status, "remote_addr", r.RemoteAddr, "duration_ms", time.Since(start).Milliseconds())
+			return true
+		}
+	}
+	c.evictor.touch(file)
+
+	if err := c.serveCached(w, r, file); err != nil {
+		http.Error(w, "failed to read cached artifact", http.StatusInternalServerError)
+		slog.Error("artifact request", "result", result, "path", file, "status", http.StatusInternalServerError, "remote_addr", r.RemoteAddr, "error", err)
+		return true
+	}
+	slog.Info("artifact request", "result", result, "path", file, "status", http.StatusOK, "remote_addr", r.RemoteAddr, "duration_ms", time.Since(start).Milliseconds())
+	return true
+}
+
+// mergeMetadata fetches the maven-metadata.xml name from every upstream routed
+// to it and caches the merged document along with its checksum files. An
+// upstream that fails contributes the copy it served last time, if any. It
+// reports whether the merged document changed.
+func (c *Cache) mergeMetadata(ctx context.Context, name string) (bool, error) {
+	rv, conditional := c.downloader.(Revalidator)
+	var docs []mavenMetadata
+	var lastErr error
+	for _, u := range c.candidates(name) {
+		if !c.breakers.allow(u) {
+			continue
+		}
+		ap := c.artifact(name, u.URL)
+		ap.name, ap.remote = mergeStageName(u, name), name
+
+		start := time.Now()
+		var err error
+		if meta, ok := c.cachedMeta(ctx, ap.name); ok && conditional {
+			_, err = rv.Revalidate(ctx, c.storage, ap, meta)
+		} else {
+			err = c.downloader.Download(ctx, c.storage, ap)
+		}
+		c.observeDownload(ap, start, err)
+		if errors.Is(err, ErrNotFound) {
+			c.negatives.add(u.URL, name)
+			for _, n := range []string{ap.name, metaName(ap.name)} {
+				if err := c.storage.Delete(ctx, n); err != nil && !errors.Is(err, fs.ErrNotExist) {
+					slog.Warn("failed to remove staged metadata", "artifact", n, "error", err)
+				}
+			}
+			continue
+		}
+		if err != nil {
+			lastErr = err
+			slog.Warn("merging metadata without a fresh copy from upstream", "artifact", name, "repository", u.Name, "error", err)
+		}
+
+		doc, err := c.readMavenMetadata(ctx, ap.name)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			lastErr = err
+			slog.Warn("skipping unusable upstream metadata", "artifact", name, "repository", u.Name, "error", err)
+			continue
+		}
+		docs = append(docs, doc)
+	}
+	if len(docs) == 0 {
+		if lastErr != nil {
+			return false, lastErr
+		}
+		if c.circuitOpen(name) {
+			return false, fmt.Errorf("merge %q: %w", name, errCircuitOpen)
+		}
+		return false, fmt.Errorf("merge %q: %w", name, ErrNotFound)
+	}
+
+	data, err := xml.MarshalIndent(mergeMavenMetadata(docs), "", "  ")
+	if err != nil {
+		return false, fmt.Errorf("encode %q: %w", name, err)
+	}
+	data = append([]byte(xml.Header), append(data, '\n')...)
+	return c.storeMerged(ctx, name, data)
+}
+
+func (c *Cache) readMavenMetadata(ctx context.Context, name string) (mavenMetadata, error) {
+	var doc mavenMetadata
+	f, _, err := c.storage.Open(ctx, name)
+	if err != nil {
+		return doc, err
+	}
+	defer f.Close()
+	if err := xml.NewDecoder(f).Decode(&doc); err != nil {
+		return doc, fmt.Errorf("decode %q: %w", name, err)
+	}
+	return doc, nil
+}
+
+// storeMerged caches the merged document data as name, next to a checksum
+// file for every supported algorithm, and reports whether it changed.
+func (c *Cache) storeMerged(ctx context.Context, name string, data []byte) (bool, error) {
+	hw := newHashingWriter()
+	_, _ = hw.Write(data)
+	checksums := make(map[string]string, len(checksumAlgorithms))
+	for _, alg := range checksumAlgorithms {
+		checksums[alg.ext] = hw.sum(alg.ext)
+	}
+	previous, err := readMeta(ctx, c.storage, name)
+	updated := err != nil || previous.Checksums["sha1"] != checksums["sha1"]
+
+	// The files are written even when unchanged, in case one was evicted.
+	if err := c.storage.Put(ctx, name, bytes.NewReader(data)); err != nil {
+		return false, fmt.Errorf("store %q: %w", name, err)
+	}
+	for _, alg := range checksumAlgorithms {
+		sum := name + "." + alg.ext
+		if err := c.storage.Put(ctx, sum, strings.NewReader(checksums[alg.ext])); err != nil {
+			return false, fmt.Errorf("store %q: %w", sum, err)
+		}
+		c.evictor.added(sum)
+	}
+	c.evictor.added(name)
+	if err := writeMeta(ctx, c.storage, name, entryMeta{FetchedAt: time.Now().UTC(), Checksums: checksums}); err != nil {
+		slog.Warn("failed to record artifact metadata", "artifact", name, "error", err)
+	}
+	return updated, nil
+}
+
+// mavenMetadata is a maven-metadata.xml document. Only the version index is
+// merged; the rest is taken from the most recently updated upstream copy.
+type mavenMetadata struct {
+	XMLName      xml.Name `xml:"metadata"`
+	ModelVersion string   `xml:"modelVersion,attr,omitempty"`
+	GroupID      string   `xml:"groupId,omitempty"`
+	ArtifactID   string   `xml:"artifactId,omitempty"`
+	Version      string   `xml:"version,omitempty"`
+	Versioning   *struct {
+		Latest           string    `xml:"latest,omitempty"`
+		Release          string    `xml:"release,omitempty"`
+		Snapshot         *innerXML `xml:"snapshot"`
+		Versions         []string  `xml:"versions>version"`
+		LastUpdated      string    `xml:"lastUpdated,omitempty"`
+		SnapshotVersions *innerXML `xml:"snapshotVersions"`
+	} `xml:"versioning"`
+	Plugins *innerXML `xml:"plugins"`
+}
+
+// innerXML carries an element through unchanged.
+type innerXML struct {
+	Content string `xml:",innerxml"`
+}
+
+// mergeMavenMetadata combines the copies of a maven-metadata.xml served by
+// different upstreams: versions are joined, and latest, release and
+// lastUpdated are the highest found in any copy.
+func mergeMavenMetadata(docs []mavenMetadata) mavenMetadata {
+	newest := 0
+	for i, doc := range docs {
+		if doc.Versioning != nil && (docs[newest].Versioning == nil || doc.Versioning.LastUpdated > docs[newest].Versioning.LastUpdated) {
+			newest = i
+		}
+	}
+	merged := docs[newest]
+	if merged.Versioning == nil {
+		return merged
+	}
+	versioning := *merged.Versioning
+	seen := make(map[string]bool)
+	versioning.Versions = nil
+	for _, doc := range docs {
+		if doc.Versioning == nil {
+			continue
+		}
+		for _, v := range doc.Versioning.Versions {
+			if v = strings.TrimSpace(v); v != "" && !seen[v] {
+				seen[v] = true
+				versioning.Versions = append(versioning.Versions, v)
+			}
+		}
+		if compareVersions(doc.Versioning.Latest, versioning.Latest) > 0 {
+			versioning.Latest = doc.Versioning.Latest
+		}
+		if compareVersions(doc.Versioning.Release, versioning.Release) > 0 {
+			versioning.Release = doc.Versioning.Release
+		}
+		if doc.Versioning.LastUpdated > versioning.LastUpdated {
+			versioning.LastUpdated = doc.Versioning.LastUpdated
+		}
+	}
+	slices.SortStableFunc(versioning.Versions, compareVersions)
+	merged.Versioning = &versioning
+	return merged
+}
+
+// compareVersions orders Maven versions the way Maven does for the common
+// cases: numeric parts compare as numbers, and qualifiers rank alpha < beta <
+// milestone < rc < snapshot < release < sp, with unknown qualifiers after
+// those in lexical order. The empty version sorts first.
+func compareVersions(a, b string) int {
+	switch {
+	case a == b:
+		return 0
+	case a == "":
+		return -1
+	case b == "":
+		return 1
+	}
+	ta, tb := versionTokens(a), versionTokens(b)
+	for i := 0; i < max(len(ta), len(tb)); i++ {
+		var x, y string
+		if i < len(ta) {
+			x = ta[i]
+		}
+		if i < len(tb) {
+			y = tb[i]
+		}
+		if n := compareVersionTokens(x, y); n != 0 {
+			return n
+		}
+	}
+	return strings.Compare(a, b)
+}
+
+// versionTokens splits a version at dots, dashes and changes between digits
+// and letters.
+func versionTokens(v string) []string {
+	var tokens []string
+	var token []byte
+	flush := func() {
+		if len(token) > 0 {
+			tokens = append(tokens, strings.ToLower(string(token)))
+			token = token[:0]
+		}
+	}
+	for i := 0; i < len(v); i++ {
+		ch := v[i]
+		if ch == '.' || ch == '-' {
+			flush()
+			continue
+		}
+		if len(token) > 0 && isDigit(ch) != isDigit(token[len(token)-1]) {
+			flush()
+		}
+		token = append(token, ch)
+	}
+	flush()
+	return tokens
+}
+
+func isDigit(b byte) bool { return b >= '0' && b <= '9' }
+
+// compareVersionTokens compares one token of two versions; a missing token
+// counts as 0 against numbers and as a release against qualifiers.
+func compareVersionTokens(x, y string) int {
+	nx, errX := strconv.ParseUint(x, 10, 64)
+	ny, errY := strconv.ParseUint(y, 10, 64)
+	switch {
+	case (errX == nil || x == "") && (errY == nil || y == ""):
+		if nx != ny {
+			if nx < ny {
+				return -1
+			}
+			return 1
+		}
+		return 0
+	case errX == nil:
+		return 1 // 1.0.1 > 1.0-rc
+	case errY == nil:
+		return -1
+	}
+	rx, ry := qualifierRank(x), qualifierRank(y)
+	if rx != ry {
+		return rx - ry
+	}
+	return strings.Compare(x, y)
+}
+
+var qualifierRanks = map[string]int{
+	"alpha": 1, "a": 1,
+	"beta": 2, "b": 2,
+	"milestone": 3, "m": 3,
+	"rc": 4, "cr": 4,
+	"snapshot": 5,
+	"":         6, "ga": 6, "final": 6, "release": 6,
+	"sp": 7,
+}
+
+func qualifierRank(q string) int {
+	if rank, ok := qualifierRanks[q]; ok {
+		return rank
+	}
+	return len(qualifierRanks) + 1
+}
@@ -0,0 +1,115 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// metaDirName is the directory under the cache root that holds articache's own
+// bookkeeping. It is never served as an artifact.
+const metaDirName = ".articache"
+
+// entryMeta is stored next to every cached artifact and describes where and
+// when it was fetched.
+type entryMeta struct {
+	Repository   string    `json:"repository"`
+	FetchedAt    time.Time `json:"fetched_at"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	// Expires is when the cached copy stops being fresh according to
+	// upstream's caching headers; zero when they said nothing.
+	Expires time.Time `json:"expires,omitzero"`
+	// Checksums maps algorithm names ("sha1", "sha256") to hex digests of
+	// the cached file.
+	Checksums map[string]string `json:"checksums,omitempty"`
+	// Unconfirmed marks a hosted release no matching checksum file has been
+	// uploaded for yet; until one is, it may be replaced or removed.
+	Unconfirmed bool `json:"unconfirmed,omitempty"`
+}
+
+// etag returns a strong entity tag derived from the recorded digest of the
+// artifact, or "" when none was recorded.
+func (m entryMeta) etag() string {
+	for _, alg := range []string{"sha256", "sha1"} {
+		if sum := m.Checksums[alg]; sum != "" {
+			return `"` + sum + `"`
+		}
+	}
+	return ""
+}
+
+// reservedDirs are the top-level directories of the cache root that hold
+// articache's bookkeeping and the storage of the caches sharing the root with
+// the top-level one.
+var reservedDirs = []string{metaDirName, ".npm", ".go", ".pypi", ".raw", ".mounts"}
+
+// reservedName reports whether name lies in one of reservedDirs.
+func reservedName(name string) bool {
+	rel := strings.TrimPrefix(name, "/")
+	for _, dir := range reservedDirs {
+		if rel == dir || strings.HasPrefix(rel, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// metaName returns the storage name of the metadata of the artifact name.
+func metaName(name string) string {
+	return "/" + metaDirName + "/meta/" + strings.TrimPrefix(name, "/") + ".json"
+}
+
+func readMeta(ctx context.Context, store Storage, name string) (entryMeta, error) {
+	var meta entryMeta
+	f, _, err := store.Open(ctx, metaName(name))
+	if err != nil {
+		return meta, err
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&meta); err != nil {
+		return meta, fmt.Errorf("decode metadata for %q: %w", name, err)
+	}
+	return meta, nil
+}
+
+func writeMeta(ctx context.Context, store Storage, name string, meta entryMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("encode metadata for %q: %w", name, err)
+	}
+	return store.Put(ctx, metaName(name), bytes.NewReader(data))
+}
+
+// writeFileAtomic writes data to a temp file next to filePath and renames it
+// into place, so readers never observe a partially written file.
+func writeFileAtomic(filePath string, data []byte) error {
+	dir := filepath.Dir(filePath)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("mkdir %q: %w", dir, err)
+	}
+	tmp, err := os.CreateTemp(dir, filepath.Base(filePath)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("create temp file: %w", err)
+	}
+	tmpName := tmp.Name()
+	defer func() {
+		_ = tmp.Close()
+		_ = os.Remove(tmpName)
+	}()
+	if _, err := tmp.Write(data); err != nil {
+		return fmt.Errorf("write %q: %w", tmpName, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close %q: %w", tmpName, err)
+	}
+	if err := os.Rename(tmpName, filePath); err != nil {
+		return fmt.Errorf("rename %q -> %q: %w", tmpName, filePath, err)
+	}
+	return nil
+}
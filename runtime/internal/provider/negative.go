@@ -0,0 +1,166 @@
+package provider
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// defaultNegativeTTL is how long an upstream is assumed not to have an
+// artifact after it answered 404 for it.
+const defaultNegativeTTL = 10 * time.Minute
+
+// negativeFlushInterval is how often expired entries are dropped from the
+// negative cache and a persistent one is written to disk when it has changed.
+const negativeFlushInterval = 30 * time.Second
+
+// negativeResults remembers which upstreams recently reported an artifact as
+// missing, so that neither fallback nor clients ask them again on every
+// request. A zero TTL disables it.
+type negativeResults struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]time.Time // repository+name -> expiry
+	path    string               // where entries are persisted; empty keeps them in memory only
+	dirty   bool
+}
+
+func newNegativeResults(ttl time.Duration) *negativeResults {
+	return &negativeResults{ttl: ttl, entries: make(map[string]time.Time)}
+}
+
+func (n *negativeResults) add(repository, name string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.ttl <= 0 {
+		return
+	}
+	n.entries[repository+name] = time.Now().Add(n.ttl)
+	n.dirty = true
+}
+
+// setTTL changes how long new results are remembered. Results already
+// recorded keep their expiry.
+func (n *negativeResults) setTTL(ttl time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.ttl = ttl
+}
+
+func (n *negativeResults) has(repository, name string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	expiry, ok := n.entries[repository+name]
+	if !ok {
+		return false
+	}
+	if time.Now().After(expiry) {
+		delete(n.entries, repository+name)
+		n.dirty = true
+		return false
+	}
+	return true
+}
+
+// load merges previously persisted entries that have not expired yet.
+func (n *negativeResults) load() error {
+	data, err := os.ReadFile(n.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var entries map[string]time.Time
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("decode %q: %w", n.path, err)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	now := time.Now()
+	for key, expiry := range entries {
+		if expiry.After(now) {
+			n.entries[key] = expiry
+		}
+	}
+	return nil
+}
+
+// prune drops the expired entries, which are otherwise only dropped when
+// looked up again. It is called with mu held.
+func (n *negativeResults) prune() {
+	now := time.Now()
+	for key, expiry := range n.entries {
+		if !expiry.After(now) {
+			delete(n.entries, key)
+			n.dirty = true
+		}
+	}
+}
+
+// flush drops the expired entries and, for a persistent negative cache,
+// writes the rest to disk if anything changed since the last flush.
+func (n *negativeResults) flush() error {
+	n.mu.Lock()
+	n.prune()
+	if !n.dirty || n.path == "" {
+		n.mu.Unlock()
+		return nil
+	}
+	entries := maps.Clone(n.entries)
+	n.dirty = false
+	n.mu.Unlock()
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return fmt.Errorf("encode negative cache: %w", err)
+	}
+	return writeFileAtomic(n.path, data)
+}
+
+func (n *negativeResults) flushLoop() {
+	ticker := time.NewTicker(negativeFlushInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := n.flush(); err != nil {
+			slog.Warn("failed to persist negative cache", "path", n.path, "error", err)
+		}
+	}
+}
+
+// SetNegativeCache configures how long upstream 404s are remembered. A zero
+// TTL disables negative caching. With persist set, entries are kept in a file
+// under the cache path and survive restarts. It must be called before Start.
+func (c *Cache) SetNegativeCache(ttl time.Duration, persist bool) {
+	c.negatives = newNegativeResults(ttl)
+	if !persist || ttl <= 0 {
+		return
+	}
+	c.negatives.path = filepath.Join(c.cachePath, metaDirName, "negative.json")
+	if err := c.negatives.load(); err != nil {
+		slog.Warn("failed to load persisted negative cache", "path", c.negatives.path, "error", err)
+	}
+}
+
+// knownMissing reports whether every upstream routed for name has recently
+// reported it as missing.
+func (c *Cache) knownMissing(name string) bool {
+	routed := false
+	for _, u := range c.upstreamList() {
+		if !u.Allows(name) {
+			continue
+		}
+		if !c.negatives.has(u.URL, name) {
+			return false
+		}
+		routed = true
+	}
+	return routed
+}
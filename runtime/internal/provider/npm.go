@@ -0,0 +1,265 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"articache/internal/metrics"
+)
+
+// npm packuments (package documents) are stored next to the package's
+// tarballs under names no package file can take. The abbreviated
+// "install-v1" form that npm install asks for is kept apart from the full one.
+const (
+	npmPackumentFile            = ".packument.json"
+	npmAbbreviatedPackumentFile = ".packument.install-v1.json"
+
+	npmAbbreviatedType = "application/vnd.npm.install-v1+json"
+)
+
+var npmPackageName = regexp.MustCompile(`^(?:@[A-Za-z0-9][A-Za-z0-9._~-]*/)?[A-Za-z0-9][A-Za-z0-9._~-]*$`)
+
+// parseNPMPath splits a registry request path into the package name and,
+// for tarball requests, the tarball file name. Scoped packages arrive as
+// "/@scope/name" once "%2f" has been decoded.
+func parseNPMPath(p string) (pkg, tarball string, err error) {
+	parts := strings.Split(strings.TrimPrefix(p, "/"), "/")
+	n := 1
+	if strings.HasPrefix(parts[0], "@") {
+		n = 2
+	}
+	if len(parts) < n {
+		return "", "", fmt.Errorf("invalid npm path %q", p)
+	}
+	pkg, rest := strings.Join(parts[:n], "/"), parts[n:]
+	if !npmPackageName.MatchString(pkg) {
+		return "", "", fmt.Errorf("invalid npm package name %q", pkg)
+	}
+	switch {
+	case len(rest) == 0:
+		return pkg, "", nil
+	case len(rest) == 2 && rest[0] == "-" && strings.HasSuffix(rest[1], ".tgz") && !strings.HasPrefix(rest[1], "."):
+		return pkg, rest[1], nil
+	default:
+		return "", "", fmt.Errorf("unsupported npm path %q", p)
+	}
+}
+
+func npmPackumentName(pkg string, abbreviated bool) string {
+	if abbreviated {
+		return "/" + pkg + "/" + npmAbbreviatedPackumentFile
+	}
+	return "/" + pkg + "/" + npmPackumentFile
+}
+
+// npmClassify treats packuments as metadata, revalidated like
+// maven-metadata.xml, and tarballs as immutable releases.
+func npmClassify(name string) PathClass {
+	if strings.HasPrefix(path.Base(name), ".packument") {
+		return ClassMetadata
+	}
+	return ClassRelease
+}
+
+// npmArtifact fills in how to fetch and verify an npm download: packuments
+// are requested under the registry's escaped package name, and tarballs are
+// checked against the integrity recorded in a cached packument.
+func (c *Cache) npmArtifact(ap *artifactPath) {
+	dir, file := path.Split(ap.name)
+	switch file {
+	case npmPackumentFile, npmAbbreviatedPackumentFile:
+		pkg := strings.Trim(dir, "/")
+		ap.remote = "/" + strings.Replace(pkg, "/", "%2f", 1)
+		ap.accept = "application/json"
+		if file == npmAbbreviatedPackumentFile {
+			ap.accept = npmAbbreviatedType + "; q=1.0, application/json; q=0.8"
+		}
+		ap.unverified = true
+	default:
+		pkg := strings.TrimSuffix(strings.TrimSuffix(dir, "/"), "/-")
+		digest := c.npmTarballDigest(strings.TrimPrefix(pkg, "/"), file)
+		ap.digest = &digest
+	}
+}
+
+type npmPackument struct {
+	Versions map[string]struct {
+		Dist struct {
+			Tarball   string `json:"tarball"`
+			Shasum    string `json:"shasum"`
+			Integrity string `json:"integrity"`
+		} `json:"dist"`
+	} `json:"versions"`
+}
+
+// npmTarballDigest looks up the digest of a tarball in the cached
+// packuments of pkg. It returns an empty digest when none lists it.
+func (c *Cache) npmTarballDigest(pkg, file string) expectedDigest {
+	ctx := context.Background()
+	for _, abbreviated := range []bool{true, false} {
+		f, _, err := c.storage.Open(ctx, npmPackumentName(pkg, abbreviated))
+		if err != nil {
+			continue
+		}
+		var doc npmPackument
+		err = json.NewDecoder(f).Decode(&doc)
+		f.Close()
+		if err != nil {
+			continue
+		}
+		for _, v := range doc.Versions {
+			u, err := url.Parse(v.Dist.Tarball)
+			if err != nil || path.Base(u.Path) != file {
+				continue
+			}
+			if d, ok := parseIntegrity(v.Dist.Integrity); ok {
+				return d
+			}
+			if raw, err := hex.DecodeString(v.Dist.Shasum); err == nil && len(raw) == 20 {
+				return expectedDigest{alg: "sha1", hex: strings.ToLower(v.Dist.Shasum)}
+			}
+		}
+	}
+	return expectedDigest{}
+}
+
+// npmVerifiable makes sure the digest of the npm tarball ap is known before
+// it is downloaded. Tarballs are often requested straight from a lockfile,
+// without the packument, or are newer than the cached one, so the packument
+// is fetched, or revalidated when cached. Tarballs it still does not list are
+// refused rather than cached unverified.
+func (c *Cache) npmVerifiable(ctx context.Context, ap *artifactPath) error {
+	if ap.digest == nil || ap.digest.alg != "" {
+		return nil
+	}
+	dir, file := path.Split(ap.name)
+	pkg := strings.TrimPrefix(strings.TrimSuffix(strings.TrimSuffix(dir, "/"), "/-"), "/")
+	packument := npmPackumentName(pkg, true)
+	if _, ok := c.lookup(ctx, npmPackumentName(pkg, false)); ok {
+		packument = npmPackumentName(pkg, false)
+	}
+	if _, ok := c.lookup(ctx, packument); ok {
+		c.revalidate(ctx, packument)
+	} else if _, err := c.fetchMetadata(ctx, packument); err != nil {
+		return fmt.Errorf("fetch packument for %q: %w", ap.name, err)
+	}
+	if *ap.digest = c.npmTarballDigest(pkg, file); ap.digest.alg == "" {
+		return fmt.Errorf("verify %q: %w", ap.name, errNotListed)
+	}
+	return nil
+}
+
+// parseIntegrity picks the strongest supported hash from a Subresource
+// Integrity string such as "sha512-<base64>".
+func parseIntegrity(integrity string) (expectedDigest, bool) {
+	var best expectedDigest
+	rank := map[string]int{"sha1": 1, "sha256": 2, "sha512": 3}
+	for _, field := range strings.Fields(integrity) {
+		alg, b64, ok := strings.Cut(field, "-")
+		if !ok || rank[alg] <= rank[best.alg] {
+			continue
+		}
+		raw, err := base64.StdEncoding.DecodeString(b64)
+		if err != nil {
+			continue
+		}
+		best = expectedDigest{alg: alg, hex: hex.EncodeToString(raw)}
+	}
+	return best, best.alg != ""
+}
+
+// handleNPMMetadata answers packument requests and requests for paths the
+// registry protocol does not define. It reports false for tarball requests,
+// which are served like any other artifact.
+func (c *Cache) handleNPMMetadata(w http.ResponseWriter, r *http.Request) bool {
+	start := time.Now()
+	pkg, tarball, err := parseNPMPath(r.URL.Path)
+	if err != nil {
+		metrics.HTTPRequestsTotal.WithLabelValues("not_found").Inc()
+		http.Error(w, "not found", http.StatusNotFound)
+		slog.Warn("invalid npm request", "path", r.URL.Path, "remote_addr", r.RemoteAddr, "error", err)
+		return true
+	}
+	if tarball != "" {
+		return false
+	}
+
+	abbreviated := strings.Contains(r.Header.Get("Accept"), npmAbbreviatedType)
+	name := npmPackumentName(pkg, abbreviated)
+	result := "hit"
+	if _, ok := c.lookup(r.Context(), name); ok {
+		metrics.HTTPRequestsTotal.WithLabelValues("hit").Inc()
+		metrics.CacheHitsTotal.Inc()
+		c.revalidateIfStale(r.Context(), name)
+	} else {
+		result = "miss"
+		status, err := c.fetchMetadata(r.Context(), name)
+		if err != nil {
+			http.Error(w, http.StatusText(status), status)
+			slog.Info("artifact request", "result", result, "path", r.URL.Path, "status", status, "remote_addr", r.RemoteAddr, "duration_ms", time.Since(start).Milliseconds())
+			return true
+		}
+	}
+	c.evictor.touch(name)
+
+	if err := c.serveNPMPackument(w, r, pkg, name, abbreviated); err != nil {
+		http.Error(w, "failed to read cached packument", http.StatusInternalServerError)
+		slog.Error("artifact request", "result", result, "path", r.URL.Path, "status", http.StatusInternalServerError, "remote_addr", r.RemoteAddr, "error", err)
+		return true
+	}
+	slog.Info("artifact request", "result", result, "path", r.URL.Path, "status", http.StatusOK, "remote_addr", r.RemoteAddr, "duration_ms", time.Since(start).Milliseconds())
+	return true
+}
+
+// serveNPMPackument answers with the cached packument, its tarball URLs
+// pointing back at the cache.
+func (c *Cache) serveNPMPackument(w http.ResponseWriter, r *http.Request, pkg, name string, abbreviated bool) error {
+	f, info, err := c.storage.Open(r.Context(), name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	dec.UseNumber()
+	var doc map[string]any
+	if err := dec.Decode(&doc); err != nil {
+		return fmt.Errorf("decode packument %q: %w", name, err)
+	}
+	base := c.externalURL(r) + "/" + pkg + "/-/"
+	versions, _ := doc["versions"].(map[string]any)
+	for _, v := range versions {
+		version, _ := v.(map[string]any)
+		dist, _ := version["dist"].(map[string]any)
+		tarball, _ := dist["tarball"].(string)
+		if u, err := url.Parse(tarball); err == nil && tarball != "" {
+			dist["tarball"] = base + path.Base(u.Path)
+		}
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(doc); err != nil {
+		return fmt.Errorf("encode packument %q: %w", name, err)
+	}
+	contentType := "application/json"
+	if abbreviated {
+		contentType = npmAbbreviatedType
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Add("Vary", "Accept")
+	http.ServeContent(w, r, "", info.ModTime, bytes.NewReader(buf.Bytes()))
+	return nil
+}
@@ -0,0 +1,207 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+)
+
+// Describer is implemented by downloaders that can fetch the headers upstream
+// sends with an artifact without downloading it. ErrNotFound reports a
+// missing artifact.
+type Describer interface {
+	Describe(ctx context.Context, ap artifactPath) (http.Header, error)
+}
+
+// RangeFetcher is implemented by downloaders that can pass the byte ranges a
+// client asks for straight from upstream, without caching them.
+type RangeFetcher interface {
+	FetchRange(ctx context.Context, ap artifactPath, r *http.Request, w http.ResponseWriter) error
+}
+
+// errRangeUnsupported is returned by FetchRange when the ranges cannot be
+// passed through and the whole artifact has to be downloaded first.
+var errRangeUnsupported = errors.New("range request not passed through")
+
+// Describe returns the headers the repository of ap answers a HEAD request
+// for the artifact with.
+func (d *HTTPDownloader) Describe(ctx context.Context, ap artifactPath) (http.Header, error) {
+	probeURL := ap.url()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, probeURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+	if ap.accept != "" {
+		req.Header.Set("Accept", ap.accept)
+	}
+	resp, err := d.send(req, ap)
+	if err != nil {
+		return nil, fmt.Errorf("probe %q: %w", probeURL, err)
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Header, nil
+	case http.StatusNotFound, http.StatusGone:
+		return nil, fmt.Errorf("probe %q: %w", probeURL, ErrNotFound)
+	default:
+		return nil, &statusError{op: "probe", url: probeURL, status: resp.StatusCode}
+	}
+}
+
+// Exists checks with a HEAD request whether the repository of ap has the artifact.
+func (d *HTTPDownloader) Exists(ctx context.Context, ap artifactPath) (bool, error) {
+	_, err := d.Describe(ctx, ap)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// FetchRange copies the ranges r asks for from the repository of ap to w.
+// Partial content cannot be checked against checksums, so under the strict
+// checksum policy it returns errRangeUnsupported, as it does when upstream
+// ignores the Range header.
+func (d *HTTPDownloader) FetchRange(ctx context.Context, ap artifactPath, r *http.Request, w http.ResponseWriter) error {
+	if d.policy() == ChecksumStrict {
+		return errRangeUnsupported
+	}
+	rangeURL := ap.url()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rangeURL, nil)
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("Range", r.Header.Get("Range"))
+	if ap.accept != "" {
+		req.Header.Set("Accept", ap.accept)
+	}
+	resp, err := d.send(req, ap)
+	if err != nil {
+		return fmt.Errorf("download range of %q: %w", rangeURL, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent, http.StatusRequestedRangeNotSatisfiable:
+	case http.StatusOK:
+		return errRangeUnsupported
+	case http.StatusNotFound, http.StatusGone:
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return fmt.Errorf("download range of %q: %w", rangeURL, ErrNotFound)
+	default:
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return &statusError{op: "download range of", url: rangeURL, status: resp.StatusCode}
+	}
+	// Upstream's entity tag would not match the one the cached copy gets.
+	copyHeaders(w.Header(), resp.Header, "Content-Type", "Content-Length", "Content-Range", "Last-Modified")
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return fmt.Errorf("%w: %w", errResponseStarted, err)
+	}
+	return nil
+}
+
+// headArtifact answers a HEAD request for a missing artifact with the headers
+// of the first upstream that has it, without downloading anything. It
+// reports false when the downloader cannot probe upstreams.
+func (c *Cache) headArtifact(w http.ResponseWriter, r *http.Request, file string) (int, bool) {
+	describer, ok := c.downloader.(Describer)
+	if !ok {
+		return 0, false
+	}
+	var lastErr error
+	for _, u := range c.candidates(file) {
+		if !c.breakers.allow(u) {
+			continue
+		}
+		h, err := describer.Describe(r.Context(), c.artifact(file, u.URL))
+		c.observeUpstream(u.URL, err)
+		if errors.Is(err, ErrNotFound) {
+			c.negatives.add(u.URL, file)
+			continue
+		}
+		if err != nil {
+			lastErr = err
+			slog.Warn("upstream probe failed", "artifact", file, "repository", u.Name, "error", err)
+			continue
+		}
+		copyHeaders(w.Header(), h, "Content-Type", "Content-Length", "Last-Modified")
+		w.WriteHeader(http.StatusOK)
+		return http.StatusOK, true
+	}
+	if lastErr != nil {
+		http.Error(w, "upstream probe failed", http.StatusBadGateway)
+		return http.StatusBadGateway, true
+	}
+	if c.circuitOpen(file) {
+		http.Error(w, "upstream unavailable", http.StatusServiceUnavailable)
+		return http.StatusServiceUnavailable, true
+	}
+	http.Error(w, "artifact not found", http.StatusNotFound)
+	return http.StatusNotFound, true
+}
+
+// proxyRange answers a range request for a missing artifact with the ranges
+// fetched from upstream, so that the client need not wait for the whole file,
+// and queues the whole file for download. It reports false when the artifact
+// has to be downloaded before the request can be answered.
+func (c *Cache) proxyRange(w http.ResponseWriter, r *http.Request, file string) (int, bool) {
+	rf, ok := c.downloader.(RangeFetcher)
+	// If-Range names a version of the cached copy, which upstream cannot
+	// compare with its own.
+	if !ok || r.Header.Get("Range") == "" || r.Header.Get("If-Range") != "" {
+		return 0, false
+	}
+	sw := &statusWriter{ResponseWriter: w}
+	var lastErr error
+	for _, u := range c.candidates(file) {
+		if !c.breakers.allow(u) {
+			continue
+		}
+		ap := c.artifact(file, u.URL)
+		err := rf.FetchRange(r.Context(), ap, r, sw)
+		c.observeUpstream(u.URL, err)
+		switch {
+		case err == nil:
+			c.enqueue(ap)
+			return sw.status, true
+		case errors.Is(err, errResponseStarted):
+			slog.Info("artifact request", "result", "miss", "path", file, "status", sw.status, "remote_addr", r.RemoteAddr, "error", err)
+			panic(http.ErrAbortHandler)
+		case errors.Is(err, errRangeUnsupported):
+			return 0, false
+		case errors.Is(err, ErrNotFound):
+			c.negatives.add(u.URL, file)
+		default:
+			lastErr = err
+			slog.Warn("range request failed upstream", "artifact", file, "repository", u.Name, "error", err)
+		}
+	}
+	if lastErr != nil {
+		http.Error(sw, "upstream download failed", http.StatusBadGateway)
+		return sw.status, true
+	}
+	if c.circuitOpen(file) {
+		http.Error(sw, "upstream unavailable", http.StatusServiceUnavailable)
+		return sw.status, true
+	}
+	http.Error(sw, "artifact not found", http.StatusNotFound)
+	return sw.status, true
+}
+
+// conditional reports whether r asks for part of an artifact or only for a
+// version the client does not have. Such requests are answered from the
+// cached copy once it is complete.
+func conditional(r *http.Request) bool {
+	for _, h := range []string{"Range", "If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since"} {
+		if r.Header.Get(h) != "" {
+			return true
+		}
+	}
+	return false
+}
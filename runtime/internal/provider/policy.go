@@ -0,0 +1,286 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"articache/internal/metrics"
+)
+
+// PathClass groups artifact paths by how they change upstream.
+type PathClass int
+
+const (
+	// ClassRelease covers released artifacts, which never change once published.
+	ClassRelease PathClass = iota
+	// ClassMetadata covers maven-metadata.xml and its checksums, which are
+	// rewritten whenever a version is published.
+	ClassMetadata
+	// ClassSnapshot covers artifacts of -SNAPSHOT versions, which are
+	// republished under the same path.
+	ClassSnapshot
+	// ClassUpstream covers files of the raw format, which are fresh for as
+	// long as upstream's Cache-Control or Expires header says.
+	ClassUpstream
+)
+
+func (pc PathClass) String() string {
+	switch pc {
+	case ClassMetadata:
+		return "metadata"
+	case ClassSnapshot:
+		return "snapshot"
+	case ClassUpstream:
+		return "upstream"
+	default:
+		return "release"
+	}
+}
+
+// classify returns the path class of an artifact path.
+func classify(name string) PathClass {
+	if strings.HasPrefix(path.Base(name), "maven-metadata") {
+		return ClassMetadata
+	}
+	if strings.Contains(name, "-SNAPSHOT/") {
+		return ClassSnapshot
+	}
+	return ClassRelease
+}
+
+// Policy sets how long cached copies of mutable path classes are served
+// before being revalidated upstream. A zero max-age treats the class as
+// immutable. RawMaxAge applies to raw files whose upstream response declared
+// no freshness of its own.
+type Policy struct {
+	MetadataMaxAge time.Duration
+	SnapshotMaxAge time.Duration
+	RawMaxAge      time.Duration
+}
+
+func DefaultPolicy() Policy {
+	return Policy{MetadataMaxAge: 30 * time.Minute, SnapshotMaxAge: 30 * time.Minute, RawMaxAge: 30 * time.Minute}
+}
+
+func (p Policy) maxAge(class PathClass) time.Duration {
+	switch class {
+	case ClassMetadata:
+		return p.MetadataMaxAge
+	case ClassSnapshot:
+		return p.SnapshotMaxAge
+	case ClassUpstream:
+		return p.RawMaxAge
+	default:
+		return 0
+	}
+}
+
+// SetPolicy sets the max-age of mutable path classes.
+func (c *Cache) SetPolicy(p Policy) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.policy = p
+}
+
+func (c *Cache) currentPolicy() Policy {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.policy
+}
+
+// Revalidator is implemented by downloaders that can check a cached artifact
+// for changes with a conditional request.
+type Revalidator interface {
+	Revalidate(ctx context.Context, store Storage, ap artifactPath, meta entryMeta) (bool, error)
+}
+
+// errNotModified is returned by conditional fetches when upstream reports the
+// cached copy as current.
+var errNotModified = errors.New("not modified")
+
+// revalidateTimeout bounds how long a revalidation waits for upstream.
+const revalidateTimeout = 10 * time.Second
+
+// revalidateWait is how long a hit waits for a revalidation before the stale
+// copy is served. The revalidation goes on in the background.
+const revalidateWait = time.Second
+
+// revalidateBackoff is how long a stale copy is served without asking
+// upstream again after revalidating it failed.
+const revalidateBackoff = time.Minute
+
+// revalidationBackoff remembers artifacts whose revalidation failed recently,
+// so that an unreachable upstream is not asked again on every hit.
+type revalidationBackoff struct {
+	mu    sync.Mutex
+	until map[string]time.Time // name -> when to try again
+}
+
+func newRevalidationBackoff() *revalidationBackoff {
+	return &revalidationBackoff{until: make(map[string]time.Time)}
+}
+
+// add defers the next revalidation of name and drops entries that expired.
+func (b *revalidationBackoff) add(name string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	for key, until := range b.until {
+		if now.After(until) {
+			delete(b.until, key)
+		}
+	}
+	b.until[name] = now.Add(revalidateBackoff)
+}
+
+// deferred reports whether name failed to revalidate too recently to try again.
+func (b *revalidationBackoff) deferred(name string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	until, ok := b.until[name]
+	if ok && time.Now().After(until) {
+		delete(b.until, name)
+		return false
+	}
+	return ok
+}
+
+// cachedMeta returns the metadata of a cached artifact. Artifacts cached
+// without metadata are described by their modification time.
+func (c *Cache) cachedMeta(ctx context.Context, name string) (entryMeta, bool) {
+	if meta, err := readMeta(ctx, c.storage, name); err == nil {
+		return meta, true
+	}
+	info, err := c.storage.Stat(ctx, name)
+	if err != nil {
+		return entryMeta{}, false
+	}
+	return entryMeta{
+		FetchedAt:    info.ModTime,
+		LastModified: info.ModTime.UTC().Format(http.TimeFormat),
+	}, true
+}
+
+// stale reports whether a cached artifact is past the max-age of its class,
+// or for raw files, past the freshness upstream declared.
+func (c *Cache) stale(ctx context.Context, name string) bool {
+	if c.isHosted(name) {
+		return false
+	}
+	class := c.classify(name)
+	maxAge := c.currentPolicy().maxAge(class)
+	if maxAge <= 0 && class != ClassUpstream {
+		return false
+	}
+	meta, ok := c.cachedMeta(ctx, name)
+	if !ok {
+		return false
+	}
+	if class == ClassUpstream && !meta.Expires.IsZero() {
+		return time.Now().After(meta.Expires)
+	}
+	return maxAge > 0 && time.Since(meta.FetchedAt) > maxAge
+}
+
+// freshUntil returns when a response received at received stops being
+// fresh according to its Cache-Control and Expires headers (RFC 9111), or
+// the zero time when it declares no freshness. Responses a shared cache may
+// not reuse without asking are stale right away.
+func freshUntil(h http.Header, received time.Time) time.Time {
+	directives := make(map[string]string)
+	for _, field := range h.Values("Cache-Control") {
+		for _, directive := range strings.Split(field, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			directives[strings.ToLower(name)] = strings.Trim(value, `"`)
+		}
+	}
+	for _, name := range []string{"no-cache", "no-store", "private"} {
+		if _, ok := directives[name]; ok {
+			return received
+		}
+	}
+	age, _ := strconv.Atoi(h.Get("Age"))
+	for _, name := range []string{"s-maxage", "max-age"} {
+		if value, ok := directives[name]; ok {
+			seconds, err := strconv.Atoi(value)
+			if err != nil {
+				return received
+			}
+			return received.Add(time.Duration(seconds-age) * time.Second)
+		}
+	}
+	if value := h.Get("Expires"); value != "" {
+		expires, err := http.ParseTime(value)
+		if err != nil {
+			// An invalid Expires, such as "0", means already expired.
+			return received
+		}
+		if date, err := http.ParseTime(h.Get("Date")); err == nil {
+			return received.Add(expires.Sub(date))
+		}
+		return expires
+	}
+	return time.Time{}
+}
+
+// revalidate asks upstream whether a stale artifact changed, replacing the
+// cached copy if it did. Failures are logged and the stale copy stays in
+// place, so clients keep being served while upstream is unreachable; it is
+// not revalidated again until revalidateBackoff has passed. Merged
+// maven-metadata.xml files are merged again.
+func (c *Cache) revalidate(ctx context.Context, name string) {
+	rv, ok := c.downloader.(Revalidator)
+	if !ok || c.backoff.deferred(name) {
+		return
+	}
+	meta, ok := c.cachedMeta(ctx, name)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), revalidateTimeout)
+	defer cancel()
+
+	var updated bool
+	try := func(ap artifactPath) error {
+		var err error
+		updated, err = rv.Revalidate(ctx, c.storage, ap, meta)
+		c.observeUpstream(ap.repository, err)
+		return err
+	}
+	var err error
+	source := c.artifact(name, meta.Repository)
+	switch doc, merged := c.mergedDocument(name); {
+	case merged:
+		updated, err = c.mergeMetadata(ctx, doc)
+	case meta.Repository != "" && c.routed(source):
+		if c.repositoryBlocked(source.repository) {
+			err = errCircuitOpen
+			break
+		}
+		err = try(source)
+	default:
+		err = c.resolve(name, try)
+	}
+
+	switch {
+	case err != nil:
+		c.backoff.add(name)
+		metrics.RevalidationsTotal.WithLabelValues("error").Inc()
+		slog.Warn("revalidation failed; serving stale copy", "artifact", name, "retry_in", revalidateBackoff, "error", err)
+	case updated:
+		metrics.RevalidationsTotal.WithLabelValues("updated").Inc()
+		c.evictor.added(name)
+		slog.Info("artifact revalidated", "artifact", name, "outcome", "updated")
+	default:
+		metrics.RevalidationsTotal.WithLabelValues("not_modified").Inc()
+		slog.Debug("artifact revalidated", "artifact", name, "outcome", "not_modified")
+	}
+}
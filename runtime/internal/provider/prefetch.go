@@ -0,0 +1,271 @@
+package provider
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"articache/internal/metrics"
+)
+
+// maxPrefetchJobs is how many prefetch jobs are remembered for progress
+// queries; the oldest are forgotten first.
+const maxPrefetchJobs = 100
+
+// prefetchJob tracks the downloads queued for one warm-up request.
+type prefetchJob struct {
+	id      string
+	created time.Time
+
+	mu        sync.Mutex
+	total     int
+	seen      map[string]struct{}
+	pending   map[string]string // artifact path -> coordinate it came from
+	cached    int
+	succeeded int
+	failed    []prefetchFailure
+}
+
+type prefetchFailure struct {
+	Coordinate string `json:"coordinate"`
+	Path       string `json:"path,omitempty"`
+	Error      string `json:"error"`
+}
+
+type prefetchStatus struct {
+	ID        string            `json:"id"`
+	Created   time.Time         `json:"created"`
+	Total     int               `json:"total"`
+	Pending   int               `json:"pending"`
+	Cached    int               `json:"cached"`
+	Succeeded int               `json:"succeeded"`
+	Failed    []prefetchFailure `json:"failed"`
+	Finished  bool              `json:"finished"`
+}
+
+func newPrefetchJob() *prefetchJob {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return &prefetchJob{id: hex.EncodeToString(b), created: time.Now().UTC(), seen: make(map[string]struct{}), pending: make(map[string]string)}
+}
+
+// add registers an artifact path to download on behalf of coordinate and
+// reports whether it is new to the job.
+func (j *prefetchJob) add(name, coordinate string) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, ok := j.seen[name]; ok {
+		return false
+	}
+	j.seen[name] = struct{}{}
+	j.pending[name] = coordinate
+	j.total++
+	return true
+}
+
+// invalid records a coordinate that could not be turned into paths.
+func (j *prefetchJob) invalid(coordinate string, reason string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.total++
+	j.failed = append(j.failed, prefetchFailure{Coordinate: coordinate, Error: reason})
+}
+
+// finish records the outcome of the download of name.
+func (j *prefetchJob) finish(name string, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	coordinate, ok := j.pending[name]
+	if !ok {
+		return
+	}
+	delete(j.pending, name)
+	if err != nil {
+		j.failed = append(j.failed, prefetchFailure{Coordinate: coordinate, Path: name, Error: err.Error()})
+		return
+	}
+	j.succeeded++
+}
+
+func (j *prefetchJob) markCached(name string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, ok := j.pending[name]; ok {
+		delete(j.pending, name)
+		j.cached++
+	}
+}
+
+func (j *prefetchJob) status() prefetchStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	failed := append([]prefetchFailure{}, j.failed...)
+	sort.Slice(failed, func(a, b int) bool { return failed[a].Coordinate < failed[b].Coordinate })
+	return prefetchStatus{
+		ID:        j.id,
+		Created:   j.created,
+		Total:     j.total,
+		Pending:   len(j.pending),
+		Cached:    j.cached,
+		Succeeded: j.succeeded,
+		Failed:    failed,
+		Finished:  len(j.pending) == 0,
+	}
+}
+
+// prefetchJobs remembers recent prefetch jobs by id.
+type prefetchJobs struct {
+	mu    sync.Mutex
+	byID  map[string]*prefetchJob
+	order []string
+}
+
+func newPrefetchJobs() *prefetchJobs {
+	return &prefetchJobs{byID: make(map[string]*prefetchJob)}
+}
+
+func (p *prefetchJobs) add(job *prefetchJob) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.byID[job.id] = job
+	p.order = append(p.order, job.id)
+	if len(p.order) > maxPrefetchJobs {
+		delete(p.byID, p.order[0])
+		p.order = p.order[1:]
+	}
+}
+
+func (p *prefetchJobs) get(id string) (*prefetchJob, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	job, ok := p.byID[id]
+	return job, ok
+}
+
+// startPrefetch queues the artifacts of coords, plus the POM of every
+// non-POM artifact, as a tracked job. Coordinates that could not be
+// turned into paths are recorded as failed right away.
+func (c *Cache) startPrefetch(coords []Coordinate, invalid []prefetchFailure) *prefetchJob {
+	job := newPrefetchJob()
+	for _, f := range invalid {
+		job.invalid(f.Coordinate, f.Error)
+	}
+
+	var queued []string
+	for _, coord := range coords {
+		names := []string{coord.Path()}
+		if coord.Extension != "pom" {
+			names = append(names, coord.POMPath())
+		}
+		for _, name := range names {
+			if !job.add(name, coord.String()) {
+				continue
+			}
+			if _, ok := c.lookup(context.Background(), name); ok {
+				job.markCached(name)
+				continue
+			}
+			queued = append(queued, name)
+		}
+	}
+	c.jobs.add(job)
+
+	// Prefetch downloads are written to the download journal like others.
+	// Held in memory, they wait for queue space instead of being dropped.
+	if c.journal == nil {
+		go func() {
+			for _, name := range queued {
+				c.queue <- artifactPath{name: name, job: job}
+				metrics.DownloadQueuedTotal.Inc()
+				metrics.DownloadQueueDepth.Set(float64(c.queueDepth()))
+			}
+		}()
+		return job
+	}
+	for _, name := range queued {
+		if err := c.journal.add(journalRecord{Name: name, Job: job.id}); err != nil {
+			job.finish(name, fmt.Errorf("queue download: %w", err))
+			continue
+		}
+		metrics.DownloadQueuedTotal.Inc()
+	}
+	metrics.DownloadQueueDepth.Set(float64(c.queueDepth()))
+	return job
+}
+
+func (c *Cache) handlePrefetchCoordinates(w http.ResponseWriter, r *http.Request) {
+	var coords []Coordinate
+	var invalid []prefetchFailure
+	scanner := bufio.NewScanner(http.MaxBytesReader(w, r.Body, 4<<20))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		coord, err := ParseCoordinate(line)
+		if err != nil {
+			invalid = append(invalid, prefetchFailure{Coordinate: line, Error: err.Error()})
+			continue
+		}
+		coords = append(coords, coord)
+	}
+	if err := scanner.Err(); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("read request: %w", err))
+		return
+	}
+	c.respondPrefetch(w, c.startPrefetch(coords, invalid))
+}
+
+func (c *Cache) handlePrefetchPOM(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, http.MaxBytesReader(w, r.Body, 4<<20)); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("read request: %w", err))
+		return
+	}
+	coords, unresolved, err := ParsePOM(buf.Bytes())
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	invalid := make([]prefetchFailure, 0, len(unresolved))
+	for _, u := range unresolved {
+		invalid = append(invalid, prefetchFailure{Coordinate: u, Error: "version or coordinates not resolvable from the POM"})
+	}
+	c.respondPrefetch(w, c.startPrefetch(coords, invalid))
+}
+
+func (c *Cache) respondPrefetch(w http.ResponseWriter, job *prefetchJob) {
+	w.Header().Set("Location", "/admin/prefetch/"+job.id)
+	writeJSON(w, http.StatusAccepted, job.status())
+}
+
+func (c *Cache) handlePrefetchStatus(w http.ResponseWriter, r *http.Request) {
+	job, ok := c.jobs.get(r.PathValue("id"))
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("unknown prefetch job %q", r.PathValue("id")))
+		return
+	}
+	writeJSON(w, http.StatusOK, job.status())
+}
+
+// downloadForJob runs a prefetch download, waiting for a transfer of the
+// same artifact already in flight instead of skipping it, and reports the
+// outcome to the job. It returns the outcome as well.
+func (c *Cache) downloadForJob(ap artifactPath) error {
+	err, _ := c.flights.do(context.Background(), flightKey(ap.name), func() error {
+		metrics.DownloadsInflight.Inc()
+		defer metrics.DownloadsInflight.Dec()
+		return c.download(context.Background(), ap)
+	})
+	ap.job.finish(ap.name, err)
+	return err
+}
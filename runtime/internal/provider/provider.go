@@ -5,31 +5,102 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"articache/internal/metrics"
 )
 
+// ErrNotFound is returned by downloaders when the upstream repository does not
+// have the requested artifact.
+var ErrNotFound = errors.New("artifact not found upstream")
+
 type Downloader interface {
-	Download(ctx context.Context, rootPath string, ap artifactPath) error
+	Download(ctx context.Context, store Storage, ap artifactPath) error
+}
+
+// StreamingDownloader is implemented by downloaders that can hand artifact bytes
+// to a client while they are being written to the cache.
+type StreamingDownloader interface {
+	DownloadTo(ctx context.Context, store Storage, ap artifactPath, w http.ResponseWriter) error
 }
 
 type HTTPDownloader struct {
-	httpClient *http.Client
+	httpClient     *http.Client
+	checksumPolicy atomic.Int32 // a ChecksumPolicy
+	retryPolicy    atomic.Pointer[RetryPolicy]
+}
+
+// MissMode controls how HandleArtifactRequest answers requests for artifacts
+// that are not cached yet.
+type MissMode int
+
+const (
+	// MissModeRedirect redirects the client upstream and downloads the artifact
+	// in the background.
+	MissModeRedirect MissMode = iota
+	// MissModeProxy fetches the artifact from upstream while the client waits,
+	// streaming it to the client and into the cache at the same time.
+	MissModeProxy
+)
+
+func ParseMissMode(mode string) (MissMode, error) {
+	switch strings.ToLower(strings.TrimSpace(mode)) {
+	case "", "redirect":
+		return MissModeRedirect, nil
+	case "proxy":
+		return MissModeProxy, nil
+	default:
+		return MissModeRedirect, fmt.Errorf("invalid miss mode %q (expected redirect or proxy)", mode)
+	}
+}
+
+func (m MissMode) String() string {
+	if m == MissModeProxy {
+		return "proxy"
+	}
+	return "redirect"
 }
 
 type Cache struct {
 	cachePath  string
+	storage    Storage
 	queue      chan artifactPath
+	handoff    chan artifactPath
+	journal    *downloadJournal
 	downloader Downloader
-	mainRepo   string
+	negatives  *negativeResults
+	backoff    *revalidationBackoff
+	breakers   *breakers
+	flights    *flightGroup
+	jobs       *prefetchJobs
+	evictor    *evictor
+	format     Format
+	baseURL    string
+	sumdb      *sumDB
+	// deploys orders checks of hosted artifacts against their checksum
+	// files with the removal or replacement of those artifacts.
+	deploys sync.Mutex
+
+	presignExpiry    time.Duration
+	noRedirectAgents []string
+
+	// mu guards the settings Reconfigure may change while requests are
+	// being served.
+	mu        sync.RWMutex
+	upstreams []Upstream
+	policy    Policy
+	missMode  MissMode
+	hosted    []string
 }
 
 func NewCache(path string, mainRepo string) *Cache {
@@ -38,183 +109,690 @@ func NewCache(path string, mainRepo string) *Cache {
 }
 
 func NewCacheWithDownloader(cachePath string, mainRepo string, downloader Downloader) *Cache {
-	// Buffered so request handling never blocks; we can drop on overflow.
 	const queueSize = 1024
+	mainRepo = strings.TrimRight(mainRepo, "/")
 	return &Cache{
 		cachePath:  cachePath,
+		storage:    NewFileStorage(cachePath),
 		queue:      make(chan artifactPath, queueSize),
+		handoff:    make(chan artifactPath, handoffSize),
 		downloader: downloader,
-		mainRepo:   strings.TrimRight(mainRepo, "/"),
+		upstreams:  []Upstream{{Name: upstreamName(mainRepo), URL: mainRepo}},
+		negatives:  newNegativeResults(defaultNegativeTTL),
+		backoff:    newRevalidationBackoff(),
+		breakers:   newBreakers(DefaultBreakerPolicy()),
+		flights:    newFlightGroup(),
+		jobs:       newPrefetchJobs(),
+		policy:     DefaultPolicy(),
 	}
 }
 
+// SetMissMode selects how cache misses are answered.
+func (c *Cache) SetMissMode(mode MissMode) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.missMode = mode
+}
+
+func (c *Cache) currentMissMode() MissMode {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.missMode
+}
+
+func upstreamName(rawURL string) string {
+	if u, err := url.Parse(rawURL); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return rawURL
+}
+
 func (c *Cache) Start(routines int) {
-	c.downloadLoop(routines, c.queue)
+	go c.negatives.flushLoop()
+	if c.evictor != nil {
+		go c.evictor.run()
+	}
+	journal, err := openJournal(filepath.Join(c.cachePath, metaDirName, "queue.journal"))
+	if err != nil {
+		slog.Warn("failed to open download journal; queuing downloads in memory", "error", err)
+	} else {
+		c.journal = journal
+		go c.feedLoop()
+	}
+	c.downloadLoop(routines, c.queue, c.handoff)
 }
 
-func (c *Cache) cacheFilePath(requestPath string) (string, error) {
-	// requestPath is a URL path like "/org/example/foo/1.0/foo-1.0.jar"
-	// Convert to a filesystem path rooted under cachePath and prevent path traversal.
-	cleanURLPath := path.Clean("/" + strings.TrimPrefix(requestPath, "/"))
-	if cleanURLPath == "/" {
+// artifactName validates a request path like "/org/example/foo/1.0/foo-1.0.jar"
+// and returns it as a clean storage name. Paths escaping the repository root
+// and articache's own bookkeeping are rejected.
+func artifactName(requestPath string) (string, error) {
+	name := path.Clean("/" + strings.TrimPrefix(requestPath, "/"))
+	if name == "/" {
 		return "", errors.New("empty artifact path")
 	}
-	rel := strings.TrimPrefix(cleanURLPath, "/")
-	fullPath := filepath.Join(c.cachePath, filepath.FromSlash(rel))
+	if reservedName(name) {
+		return "", errors.New("reserved artifact path")
+	}
+	return name, nil
+}
 
-	// Ensure fullPath stays within cachePath.
-	relCheck, err := filepath.Rel(c.cachePath, fullPath)
+// lookup reports whether requestPath is cached.
+func (c *Cache) lookup(ctx context.Context, requestPath string) (ObjectInfo, bool) {
+	name, err := artifactName(requestPath)
 	if err != nil {
-		return "", fmt.Errorf("compute relative path: %w", err)
+		return ObjectInfo{}, false
 	}
-	if relCheck == "." || strings.HasPrefix(relCheck, ".."+string(filepath.Separator)) || relCheck == ".." {
-		return "", errors.New("invalid artifact path")
+	info, err := c.storage.Stat(ctx, name)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			slog.Warn("failed to stat cached artifact", "artifact", name, "error", err)
+		}
+		return ObjectInfo{}, false
 	}
-
-	return fullPath, nil
+	return info, true
 }
 
-func (c *Cache) findRequestedFile(requestPath string) (string, bool) {
-	fullPath, err := c.cacheFilePath(requestPath)
+// serveCached answers r with the cached copy of name, tagged with its digest
+// so that conditional requests keep matching across revalidations.
+func (c *Cache) serveCached(w http.ResponseWriter, r *http.Request, name string) error {
+	f, info, err := c.storage.Open(r.Context(), name)
 	if err != nil {
-		return "", false
+		return err
 	}
-	if _, err := os.Stat(fullPath); err == nil {
-		return fullPath, true
+	defer f.Close()
+	if meta, err := readMeta(r.Context(), c.storage, name); err == nil && meta.etag() != "" {
+		w.Header().Set("ETag", meta.etag())
 	}
-	return "", false
+	http.ServeContent(w, r, name, info.ModTime, f)
+	return nil
+}
 
+func (d *HTTPDownloader) Download(ctx context.Context, store Storage, ap artifactPath) error {
+	return d.fetch(ctx, store, ap, nil, nil)
 }
 
-func (d *HTTPDownloader) Download(ctx context.Context, rootPath string, ap artifactPath) error {
-	downloadURL := strings.TrimRight(ap.repository, "/") + ap.name
+// DownloadTo downloads ap like Download and copies the body to w as it arrives.
+// The cached copy is committed only after the whole body has been received from
+// upstream; a client that goes away mid-transfer does not abort the download.
+func (d *HTTPDownloader) DownloadTo(ctx context.Context, store Storage, ap artifactPath, w http.ResponseWriter) error {
+	return d.fetch(ctx, store, ap, w, nil)
+}
+
+// Revalidate makes a conditional request for a cached artifact described by
+// meta. It reports whether upstream sent a new version, which then replaces
+// the cached copy.
+func (d *HTTPDownloader) Revalidate(ctx context.Context, store Storage, ap artifactPath, meta entryMeta) (bool, error) {
+	err := d.fetch(ctx, store, ap, nil, &meta)
+	if errors.Is(err, errNotModified) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// fetch downloads ap into store, copying the body to w when it is set. With
+// cached set the request is conditional; errNotModified is returned when the
+// cached copy is still current. Transient failures are retried until the
+// response to w has been started.
+func (d *HTTPDownloader) fetch(ctx context.Context, store Storage, ap artifactPath, w http.ResponseWriter, cached *entryMeta) error {
+	var sw *startedWriter
+	if w != nil {
+		sw = &startedWriter{ResponseWriter: w}
+		w = sw
+	}
+	return d.retry(ctx, func() error {
+		return d.fetchOnce(ctx, store, ap, w, cached)
+	}, func() bool {
+		return sw != nil && sw.started
+	})
+}
+
+func (d *HTTPDownloader) fetchOnce(ctx context.Context, store Storage, ap artifactPath, w http.ResponseWriter, cached *entryMeta) error {
+	downloadURL := ap.url()
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, downloadURL, nil)
 	if err != nil {
 		return fmt.Errorf("create request: %w", err)
 	}
+	if ap.accept != "" {
+		req.Header.Set("Accept", ap.accept)
+	}
+	if cached != nil {
+		if cached.ETag != "" {
+			req.Header.Set("If-None-Match", cached.ETag)
+		}
+		if cached.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
 
-	resp, err := d.httpClient.Do(req)
+	resp, err := d.send(req, ap)
 	if err != nil {
 		return fmt.Errorf("download %q: %w", downloadURL, err)
 	}
 	defer resp.Body.Close()
 
+	if cached != nil && resp.StatusCode == http.StatusNotModified {
+		refreshed := *cached
+		refreshed.Repository = ap.repository
+		refreshed.FetchedAt = time.Now().UTC()
+		refreshed.Expires = freshUntil(resp.Header, refreshed.FetchedAt)
+		if err := writeMeta(ctx, store, ap.name, refreshed); err != nil {
+			slog.Warn("failed to record artifact metadata", "artifact", ap.name, "error", err)
+		}
+		return errNotModified
+	}
+
 	if resp.StatusCode != http.StatusOK {
 		// drain body (best effort) to allow connection reuse
 		_, _ = io.Copy(io.Discard, resp.Body)
-		return fmt.Errorf("download %q: unexpected status %d", downloadURL, resp.StatusCode)
+		if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone {
+			return fmt.Errorf("download %q: %w", downloadURL, ErrNotFound)
+		}
+		return &statusError{op: "download", url: downloadURL, status: resp.StatusCode}
 	}
 
-	filePath := filepath.Join(rootPath, filepath.FromSlash(strings.TrimPrefix(ap.name, "/")))
-	dir := filepath.Dir(filePath)
-	if err := os.MkdirAll(dir, 0o755); err != nil {
-		return fmt.Errorf("mkdir %q: %w", dir, err)
+	verify := d.policy() != ChecksumOff && !isChecksumFile(ap.name) && !ap.unverified
+	hw := newHashingWriter()
+	var body io.Reader = io.TeeReader(resp.Body, hw)
+	if w != nil {
+		// Upstream's entity tag would not match the one the cached copy gets.
+		copyHeaders(w.Header(), resp.Header, "Content-Type", "Last-Modified")
+		if !verify {
+			copyHeaders(w.Header(), resp.Header, "Content-Length")
+		}
+		// Without a Content-Length the body is chunked, so a client only
+		// sees a complete response once verification has passed.
+		w.WriteHeader(http.StatusOK)
+		body = io.TeeReader(body, &clientWriter{w: w})
 	}
-
-	tmp, err := os.CreateTemp(dir, filepath.Base(filePath)+".*.tmp")
-	if err != nil {
-		return fmt.Errorf("create temp file: %w", err)
+	if verify && ap.verifyFile != nil {
+		// The format's check needs the whole file, so the body is spooled
+		// and verified before anything is stored.
+		spooled, err := spoolBody(body)
+		if err != nil {
+			return fmt.Errorf("download %q: %w", downloadURL, err)
+		}
+		defer func() {
+			_ = spooled.Close()
+			_ = os.Remove(spooled.Name())
+		}()
+		if err := ap.verifyFile(ctx, spooled); err != nil {
+			if errors.Is(err, ErrChecksumMismatch) {
+				metrics.ChecksumFailuresTotal.Inc()
+			}
+			return err
+		}
+		if _, err := spooled.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("rewind %q: %w", spooled.Name(), err)
+		}
+		body, verify = spooled, false
+	}
+	var vr *verifyingReader
+	if verify {
+		// Verifying before the body ends lets Put discard a bad download
+		// instead of committing it.
+		vr = &verifyingReader{r: body, verify: func() error {
+			if ap.digest != nil {
+				return d.verifyDigest(downloadURL, *ap.digest, hw)
+			}
+			return d.verify(ctx, ap, downloadURL, hw)
+		}}
+		body = vr
 	}
-	tmpName := tmp.Name()
-	defer func() {
-		_ = tmp.Close()
-		_ = os.Remove(tmpName)
-	}()
 
-	if _, err := io.Copy(tmp, resp.Body); err != nil {
-		return fmt.Errorf("write %q: %w", tmpName, err)
+	if err := store.Put(ctx, ap.name, body); err != nil {
+		if vr != nil && vr.err != nil {
+			if errors.Is(vr.err, ErrChecksumMismatch) {
+				metrics.ChecksumFailuresTotal.Inc()
+			}
+			return vr.err
+		}
+		return fmt.Errorf("store %q: %w", ap.name, err)
 	}
-	if err := tmp.Close(); err != nil {
-		return fmt.Errorf("close %q: %w", tmpName, err)
+	fetchedAt := time.Now().UTC()
+	meta := entryMeta{
+		Repository:   ap.repository,
+		FetchedAt:    fetchedAt,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Expires:      freshUntil(resp.Header, fetchedAt),
+		Checksums:    hw.digests(),
 	}
-
-	if err := os.Rename(tmpName, filePath); err != nil {
-		return fmt.Errorf("rename %q -> %q: %w", tmpName, filePath, err)
+	if err := writeMeta(ctx, store, ap.name, meta); err != nil {
+		slog.Warn("failed to record artifact metadata", "artifact", ap.name, "error", err)
 	}
 
 	slog.Info("artifact downloaded", "url", downloadURL)
 	return nil
 }
 
-func (c *Cache) download(ctx context.Context, ap artifactPath) {
+// spoolBody copies r to a temp file.
+func spoolBody(r io.Reader) (*os.File, error) {
+	f, err := os.CreateTemp("", "articache-*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("create temp file: %w", err)
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return nil, fmt.Errorf("write %q: %w", f.Name(), err)
+	}
+	return f, nil
+}
+
+func copyHeaders(dst, src http.Header, keys ...string) {
+	for _, k := range keys {
+		if v := src.Get(k); v != "" {
+			dst.Set(k, v)
+		}
+	}
+}
+
+// clientWriter forwards writes to a client until the first failure and then
+// silently discards the rest, so that a disconnecting client does not stop the
+// body from reaching the cache.
+type clientWriter struct {
+	w      io.Writer
+	failed bool
+}
+
+func (cw *clientWriter) Write(p []byte) (int, error) {
+	if !cw.failed {
+		if _, err := cw.w.Write(p); err != nil {
+			cw.failed = true
+		}
+	}
+	return len(p), nil
+}
+
+func (c *Cache) download(ctx context.Context, ap artifactPath) error {
+	if doc, ok := c.mergedDocument(ap.name); ok && ap.repository == "" {
+		_, err := c.mergeMetadata(ctx, doc)
+		return err
+	}
+	if ap.repository == "" {
+		return c.resolve(ap.name, func(ap artifactPath) error {
+			return c.download(ctx, ap)
+		})
+	}
+	if !c.routed(ap) {
+		slog.Warn("skipping download not allowed by routing", "artifact", ap.name, "repository", ap.repository)
+		return fmt.Errorf("repository %q is not routed for %q", ap.repository, ap.name)
+	}
+	if c.repositoryBlocked(ap.repository) {
+		return fmt.Errorf("download %q from %q: %w", ap.name, ap.repository, errCircuitOpen)
+	}
+	if err := c.verifiable(ctx, &ap); err != nil {
+		return err
+	}
 	start := time.Now()
-	if err := c.downloader.Download(ctx, c.cachePath, ap); err != nil {
+	err := c.downloader.Download(ctx, c.storage, ap)
+	c.observeDownload(ap, start, err)
+	if errors.Is(err, ErrNotFound) {
+		c.negatives.add(ap.repository, ap.name)
+	}
+	return err
+}
+
+func (c *Cache) observeDownload(ap artifactPath, start time.Time, err error) {
+	metrics.DownloadDurationSeconds.Observe(time.Since(start).Seconds())
+	c.observeUpstream(ap.repository, err)
+	if errors.Is(err, ErrNotFound) {
+		metrics.DownloadsTotal.WithLabelValues("failure").Inc()
+		slog.Info("artifact not found upstream", "artifact", ap.name, "repository", ap.repository)
+		return
+	}
+	if err != nil {
 		metrics.DownloadsTotal.WithLabelValues("failure").Inc()
-		metrics.DownloadDurationSeconds.Observe(time.Since(start).Seconds())
 		slog.Error("artifact download failed", "artifact", ap.name, "repository", ap.repository, "error", err)
 		return
 	}
 	metrics.DownloadsTotal.WithLabelValues("success").Inc()
-	metrics.DownloadDurationSeconds.Observe(time.Since(start).Seconds())
+	c.evictor.added(ap.name)
 }
 
 type artifactPath struct {
-	name       string
+	name string
+	// repository is the upstream URL to download from; when empty the
+	// artifact is resolved against the configured upstreams in order.
 	repository string
+	// job, when set, is told the outcome of the download.
+	job *prefetchJob
+	// remote is the path to request upstream when it differs from name, or
+	// an absolute URL for formats whose files live outside the repository,
+	// and accept the Accept header to send with it.
+	remote string
+	accept string
+	// digest, when set, replaces the lookup of upstream checksum files with
+	// the digest published in the format's metadata. unverified marks files
+	// for which the format publishes no checksum at all.
+	digest     *expectedDigest
+	unverified bool
+	// verifyFile, when set, checks the complete download in place of
+	// checksum files, for formats whose hashes cover more than the bytes.
+	verifyFile func(ctx context.Context, f *os.File) error
+	// credentials authenticate requests to repository.
+	credentials *Credentials
+	// journaled marks downloads read from the download journal, which is
+	// told their outcome.
+	journaled bool
 }
 
-func (c *Cache) downloadLoop(count int, queue <-chan artifactPath) {
-	var mu sync.Mutex
-	inflight := make(map[string]struct{})
+// url returns the upstream URL of ap.
+func (ap artifactPath) url() string {
+	remote := ap.remote
+	if remote == "" {
+		remote = ap.name
+	}
+	if strings.Contains(remote, "://") {
+		return remote
+	}
+	return strings.TrimRight(ap.repository, "/") + remote
+}
 
+// downloadLoop starts count workers taking downloads from queue, where they
+// are held in memory, and from handoff, where feedLoop passes those read from
+// the download journal.
+func (c *Cache) downloadLoop(count int, queue, handoff <-chan artifactPath) {
 	for i := 0; i < count; i++ {
 		go func() {
-			for val := range queue {
-				metrics.DownloadQueueDepth.Set(float64(len(c.queue)))
-				mu.Lock()
-				if _, ok := inflight[val.name]; ok {
-					mu.Unlock()
-					continue
+			for {
+				var val artifactPath
+				select {
+				case val = <-queue:
+				case val = <-handoff:
+				}
+				metrics.DownloadQueueDepth.Set(float64(c.queueDepth()))
+				var err error
+				if val.job != nil {
+					err = c.downloadForJob(val)
+				} else {
+					// A job for an artifact that is already being fetched, in
+					// the background or for a waiting client, is redundant.
+					ran := c.flights.tryDo(flightKey(val.name), func() error {
+						metrics.DownloadsInflight.Inc()
+						defer metrics.DownloadsInflight.Dec()
+						err = c.download(context.Background(), val)
+						return err
+					})
+					if !ran {
+						metrics.CoalescedRequestsTotal.Inc()
+						err = errCoalesced
+					}
+				}
+				if val.journaled {
+					rec := journalRecord{Name: val.name, Repository: val.repository}
+					if val.job != nil {
+						rec.Job = val.job.id
+					}
+					c.journal.finish(rec, err)
 				}
-				inflight[val.name] = struct{}{}
-				mu.Unlock()
-
-				metrics.DownloadsInflight.Inc()
-				c.download(context.Background(), val)
-				metrics.DownloadsInflight.Dec()
-
-				mu.Lock()
-				delete(inflight, val.name)
-				mu.Unlock()
 			}
 		}()
 	}
 }
 
+// HandleArtifactRequest answers GET and HEAD requests for artifacts, from the
+// cache or, on a miss, by redirecting to or proxying from upstream, and PUT
+// requests below hosted prefixes. HEAD misses are answered by probing
+// upstream without downloading, and range requests on proxied misses are
+// passed through while the whole artifact is downloaded in the background.
 func (c *Cache) HandleArtifactRequest(w http.ResponseWriter, r *http.Request) {
-	file := r.URL.Path
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPut:
+		c.handleUpload(w, r)
+		return
+	default:
+		metrics.HTTPRequestsTotal.WithLabelValues("bad_request").Inc()
+		allow := "GET, HEAD"
+		if name, err := artifactName(r.URL.Path); err == nil && c.isHosted(name) {
+			allow += ", PUT"
+		}
+		w.Header().Set("Allow", allow)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		slog.Info("artifact request", "result", "bad_request", "path", r.URL.Path, "method", r.Method, "status", http.StatusMethodNotAllowed, "remote_addr", r.RemoteAddr)
+		return
+	}
+	switch c.format {
+	case FormatMaven:
+		if c.handleMavenMetadata(w, r) {
+			return
+		}
+	case FormatNPM:
+		if c.handleNPMMetadata(w, r) {
+			return
+		}
+	case FormatPyPI:
+		if c.handlePyPIIndex(w, r) {
+			return
+		}
+	case FormatGo:
+		if _, err := parseGoPath(r.URL.Path); err != nil {
+			// The module proxy protocol answers anything it cannot serve
+			// with 404, which makes the go command try its next source.
+			metrics.HTTPRequestsTotal.WithLabelValues("not_found").Inc()
+			http.Error(w, "not found", http.StatusNotFound)
+			slog.Info("invalid module proxy request", "path", r.URL.Path, "remote_addr", r.RemoteAddr, "error", err)
+			return
+		}
+	}
 	start := time.Now()
 
-	if _, err := c.cacheFilePath(file); err != nil {
+	file, err := artifactName(r.URL.Path)
+	if err != nil {
 		metrics.HTTPRequestsTotal.WithLabelValues("bad_request").Inc()
 		http.Error(w, "invalid artifact path", http.StatusBadRequest)
-		slog.Warn("invalid artifact request", "path", file, "remote_addr", r.RemoteAddr, "duration_ms", time.Since(start).Milliseconds())
+		slog.Warn("invalid artifact request", "path", r.URL.Path, "remote_addr", r.RemoteAddr, "duration_ms", time.Since(start).Milliseconds())
 		return
 	}
 
-	if filePath, ok := c.findRequestedFile(file); !ok {
+	if _, ok := c.lookup(r.Context(), file); !ok {
+		if c.knownMissing(file) {
+			metrics.HTTPRequestsTotal.WithLabelValues("not_found").Inc()
+			metrics.NegativeCacheHitsTotal.Inc()
+			http.Error(w, "artifact not found", http.StatusNotFound)
+			slog.Info("artifact request", "result", "not_found", "path", file, "status", http.StatusNotFound, "remote_addr", r.RemoteAddr, "duration_ms", time.Since(start).Milliseconds())
+			return
+		}
 		metrics.HTTPRequestsTotal.WithLabelValues("miss").Inc()
 		metrics.CacheMissesTotal.Inc()
-		repo := c.mainRepo
-		alternatePath := repo + file
-		http.Redirect(w, r, alternatePath, http.StatusSeeOther)
-		select {
-		case c.queue <- artifactPath{file, repo}:
-			metrics.DownloadQueuedTotal.Inc()
-			metrics.DownloadQueueDepth.Set(float64(len(c.queue)))
-		default:
-			metrics.DownloadQueueDroppedTotal.Inc()
-			metrics.DownloadQueueDepth.Set(float64(len(c.queue)))
-			slog.Warn("download queue full; skipping async download", "artifact", file)
+		if r.Method == http.MethodHead {
+			if status, ok := c.headArtifact(w, r, file); ok {
+				slog.Info("artifact request", "result", "miss", "path", file, "method", r.Method, "status", status, "remote_addr", r.RemoteAddr, "duration_ms", time.Since(start).Milliseconds())
+				return
+			}
+		}
+		if c.currentMissMode() == MissModeProxy {
+			status := c.proxyArtifact(w, r, file)
+			slog.Info("artifact request", "result", "miss", "path", file, "status", status, "remote_addr", r.RemoteAddr, "duration_ms", time.Since(start).Milliseconds())
+			return
+		}
+		upstream, ok := c.locate(r.Context(), file)
+		if !ok && c.circuitOpen(file) {
+			http.Error(w, "upstream unavailable", http.StatusServiceUnavailable)
+			slog.Info("artifact request", "result", "miss", "path", file, "status", http.StatusServiceUnavailable, "remote_addr", r.RemoteAddr, "duration_ms", time.Since(start).Milliseconds())
+			return
+		}
+		if !ok {
+			http.Error(w, "artifact not found", http.StatusNotFound)
+			slog.Info("artifact request", "result", "miss", "path", file, "status", http.StatusNotFound, "remote_addr", r.RemoteAddr, "duration_ms", time.Since(start).Milliseconds())
+			return
 		}
+		if upstream.Credentials != nil {
+			// Redirected clients would lack the credentials the upstream requires.
+			status := c.proxyArtifact(w, r, file)
+			slog.Info("artifact request", "result", "miss", "path", file, "status", status, "remote_addr", r.RemoteAddr, "duration_ms", time.Since(start).Milliseconds())
+			return
+		}
+		ap := c.artifact(file, upstream.URL)
+		if err := c.verifiable(r.Context(), &ap); err != nil {
+			status := http.StatusBadGateway
+			if errors.Is(err, ErrNotFound) {
+				status = http.StatusNotFound
+			}
+			http.Error(w, http.StatusText(status), status)
+			slog.Info("artifact request", "result", "miss", "path", file, "status", status, "remote_addr", r.RemoteAddr, "duration_ms", time.Since(start).Milliseconds(), "error", err)
+			return
+		}
+		http.Redirect(w, r, ap.url(), http.StatusSeeOther)
+		c.enqueue(ap)
 		slog.Info("artifact request", "result", "miss", "path", file, "status", http.StatusSeeOther, "remote_addr", r.RemoteAddr, "duration_ms", time.Since(start).Milliseconds())
 
 	} else {
 		metrics.HTTPRequestsTotal.WithLabelValues("hit").Inc()
 		metrics.CacheHitsTotal.Inc()
-		http.ServeFile(w, r, filePath)
+		c.revalidateIfStale(r.Context(), file)
+		c.evictor.touch(file)
+		if c.redirectHit(w, r, file) {
+			slog.Info("artifact request", "result", "hit", "path", file, "status", http.StatusTemporaryRedirect, "remote_addr", r.RemoteAddr, "duration_ms", time.Since(start).Milliseconds())
+			return
+		}
+		if err := c.serveCached(w, r, file); err != nil {
+			http.Error(w, "failed to read cached artifact", http.StatusInternalServerError)
+			slog.Error("artifact request", "result", "hit", "path", file, "status", http.StatusInternalServerError, "remote_addr", r.RemoteAddr, "error", err)
+			return
+		}
 		slog.Info("artifact request", "result", "hit", "path", file, "status", http.StatusOK, "remote_addr", r.RemoteAddr, "duration_ms", time.Since(start).Milliseconds())
 	}
 
 }
+
+// revalidateIfStale revalidates a cached artifact past its max-age before it
+// is served. Concurrent hits share a single revalidation and wait for it up to
+// revalidateWait, after which the stale copy is served while it goes on.
+func (c *Cache) revalidateIfStale(ctx context.Context, name string) {
+	if !c.stale(ctx, name) || c.backoff.deferred(name) {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, leader := c.flights.do(context.WithoutCancel(ctx), flightKey(name), func() error {
+			c.revalidate(ctx, name)
+			return nil
+		})
+		if !leader {
+			metrics.CoalescedRequestsTotal.Inc()
+		}
+	}()
+	timer := time.NewTimer(revalidateWait)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// enqueue schedules a background download without blocking and reports
+// whether the job was accepted. Once the cache is started jobs are written to
+// the download journal; before, or when it cannot be opened, they are held in
+// memory and dropped when the queue is full.
+func (c *Cache) enqueue(ap artifactPath) bool {
+	if c.journal != nil {
+		if err := c.journal.add(journalRecord{Name: ap.name, Repository: ap.repository}); err != nil {
+			metrics.DownloadQueueDroppedTotal.Inc()
+			slog.Warn("failed to queue download; skipping async download", "artifact", ap.name, "error", err)
+			return false
+		}
+		metrics.DownloadQueuedTotal.Inc()
+		metrics.DownloadQueueDepth.Set(float64(c.queueDepth()))
+		return true
+	}
+	select {
+	case c.queue <- ap:
+		metrics.DownloadQueuedTotal.Inc()
+		metrics.DownloadQueueDepth.Set(float64(c.queueDepth()))
+		return true
+	default:
+		metrics.DownloadQueueDroppedTotal.Inc()
+		metrics.DownloadQueueDepth.Set(float64(c.queueDepth()))
+		slog.Warn("download queue full; skipping async download", "artifact", ap.name)
+		return false
+	}
+}
+
+// proxyArtifact fetches a missing artifact from upstream while the client waits
+// and returns the HTTP status sent to the client. Conditional and range
+// requests are answered from the cached copy once it is complete, unless the
+// ranges can be passed through.
+func (c *Cache) proxyArtifact(w http.ResponseWriter, r *http.Request, file string) int {
+	if status, ok := c.proxyRange(w, r, file); ok {
+		return status
+	}
+	sw := &statusWriter{ResponseWriter: w}
+	// The download outlives the client so that the cache still gets populated
+	// when the client disconnects halfway through.
+	ctx := context.WithoutCancel(r.Context())
+
+	// Concurrent requests for the same missing artifact wait for the first
+	// one's transfer and are then served from the cache.
+	err, leader := c.flights.do(r.Context(), flightKey(file), func() error {
+		metrics.DownloadsInflight.Inc()
+		defer metrics.DownloadsInflight.Dec()
+		return c.resolve(file, func(ap artifactPath) error {
+			if err := c.verifiable(ctx, &ap); err != nil {
+				return err
+			}
+			start := time.Now()
+			var err error
+			if sd, ok := c.downloader.(StreamingDownloader); ok && !conditional(r) {
+				err = sd.DownloadTo(ctx, c.storage, ap, sw)
+			} else {
+				err = c.downloader.Download(ctx, c.storage, ap)
+			}
+			c.observeDownload(ap, start, err)
+			if err != nil && sw.status != 0 {
+				return fmt.Errorf("%w: %w", errResponseStarted, err)
+			}
+			return err
+		})
+	})
+	if !leader {
+		metrics.CoalescedRequestsTotal.Inc()
+	}
+
+	switch {
+	case err != nil && sw.status != 0:
+		// Headers are already out. Abort the connection so that the client
+		// sees a failed transfer instead of a complete but bad artifact.
+		slog.Info("artifact request", "result", "miss", "path", file, "status", sw.status, "remote_addr", r.RemoteAddr, "error", err)
+		panic(http.ErrAbortHandler)
+	case errors.Is(err, ErrNotFound):
+		http.Error(sw, "artifact not found", http.StatusNotFound)
+	case errors.Is(err, errCircuitOpen):
+		http.Error(sw, "upstream unavailable", http.StatusServiceUnavailable)
+	case err != nil:
+		http.Error(sw, "upstream download failed", http.StatusBadGateway)
+	case sw.status == 0:
+		if err := c.serveCached(sw, r, file); err != nil {
+			http.Error(sw, "upstream download failed", http.StatusBadGateway)
+		}
+	}
+	return sw.status
+}
+
+// errResponseStarted marks download errors that happened after the response to
+// the client was started, when falling back to another upstream is impossible.
+var errResponseStarted = errors.New("response already started")
+
+// statusWriter remembers the status code written to the wrapped ResponseWriter.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	if sw.status == 0 {
+		sw.status = code
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *statusWriter) Write(p []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(p)
+}
@@ -0,0 +1,477 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"articache/internal/metrics"
+)
+
+// Project pages of the simple repository API are stored under
+// "/simple/<project>/" in whichever form upstream answered with, and the
+// files they link to under "/packages/<project>/<filename>".
+const (
+	pypiProjectFile = ".project"
+
+	pypiJSONType = "application/vnd.pypi.simple.v1+json"
+	pypiHTMLType = "application/vnd.pypi.simple.v1+html"
+
+	// pypiUpstreamAccept is the Accept header pip sends: JSON preferred,
+	// HTML from indexes that predate PEP 691.
+	pypiUpstreamAccept = pypiJSONType + ", " + pypiHTMLType + "; q=0.1, text/html; q=0.01"
+)
+
+var (
+	pypiProjectName   = regexp.MustCompile(`^(?i:[a-z0-9]|[a-z0-9][a-z0-9._-]*[a-z0-9])$`)
+	pypiNameSeparator = regexp.MustCompile(`[-_.]+`)
+)
+
+// pypiNormalize returns the PEP 503 normalized form of a project name.
+func pypiNormalize(project string) string {
+	return strings.ToLower(pypiNameSeparator.ReplaceAllString(project, "-"))
+}
+
+// parsePyPIPath splits a request path into the project and, for file
+// requests, the file name. Project pages are "/simple/<project>/" with the
+// name in any form; files are "/packages/<project>/<filename>" with the
+// normalized name, as the rewritten links have it.
+func parsePyPIPath(p string) (project, file string, err error) {
+	parts := strings.Split(strings.TrimPrefix(p, "/"), "/")
+	switch {
+	case len(parts) >= 2 && len(parts) <= 3 && parts[0] == "simple" && (len(parts) == 2 || parts[2] == ""):
+		project = parts[1]
+	case len(parts) == 3 && parts[0] == "packages" && parts[1] == pypiNormalize(parts[1]):
+		project, file = parts[1], parts[2]
+		if file == "" || strings.HasPrefix(file, ".") {
+			return "", "", fmt.Errorf("invalid file name %q", file)
+		}
+	default:
+		return "", "", fmt.Errorf("unsupported simple repository path %q", p)
+	}
+	if !pypiProjectName.MatchString(project) {
+		return "", "", fmt.Errorf("invalid project name %q", project)
+	}
+	return project, file, nil
+}
+
+func pypiProjectPage(project string) string {
+	return "/simple/" + project + "/" + pypiProjectFile
+}
+
+// pypiClassify treats project pages as metadata and distribution files as
+// immutable releases.
+func pypiClassify(name string) PathClass {
+	if path.Base(name) == pypiProjectFile {
+		return ClassMetadata
+	}
+	return ClassRelease
+}
+
+// pypiProject is a project page in the JSON form of PEP 691, which HTML
+// pages are parsed into.
+type pypiProject struct {
+	Meta struct {
+		APIVersion string `json:"api-version"`
+	} `json:"meta"`
+	Name     string     `json:"name"`
+	Files    []pypiFile `json:"files"`
+	Versions []string   `json:"versions,omitempty"`
+}
+
+type pypiFile struct {
+	Filename       string            `json:"filename"`
+	URL            string            `json:"url"`
+	Hashes         map[string]string `json:"hashes"`
+	RequiresPython string            `json:"requires-python,omitempty"`
+	// CoreMetadata is true, false or the hashes of the file's metadata
+	// (PEP 658); DistInfoMetadata is its name before PEP 714.
+	CoreMetadata     json.RawMessage `json:"core-metadata,omitempty"`
+	DistInfoMetadata json.RawMessage `json:"dist-info-metadata,omitempty"`
+	GPGSig           *bool           `json:"gpg-sig,omitempty"`
+	// Yanked is true, false or the reason the file was yanked.
+	Yanked     any    `json:"yanked,omitempty"`
+	Size       *int64 `json:"size,omitempty"`
+	UploadTime string `json:"upload-time,omitempty"`
+}
+
+// metadataHashes interprets a core-metadata value, reporting whether the
+// file's metadata is available at all.
+func (f pypiFile) metadataHashes() (map[string]string, bool) {
+	raw := f.CoreMetadata
+	if len(raw) == 0 {
+		raw = f.DistInfoMetadata
+	}
+	var available bool
+	if json.Unmarshal(raw, &available) == nil {
+		return nil, available
+	}
+	var hashes map[string]string
+	if json.Unmarshal(raw, &hashes) == nil {
+		return hashes, true
+	}
+	return nil, false
+}
+
+// pypiDigest picks the hash to verify a download with, strongest first.
+func pypiDigest(hashes map[string]string) expectedDigest {
+	for _, alg := range []string{"sha512", "sha256", "sha1", "md5"} {
+		if hex := hashes[alg]; hex != "" {
+			return expectedDigest{alg: alg, hex: strings.ToLower(hex)}
+		}
+	}
+	return expectedDigest{}
+}
+
+var (
+	htmlAnchor    = regexp.MustCompile(`(?is)<a\s([^>]*)>(.*?)</a\s*>`)
+	htmlAttribute = regexp.MustCompile(`([^\s"'>/=]+)(?:\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'=<>` + "`" + `]+)))?`)
+	htmlTag       = regexp.MustCompile(`<[^>]*>`)
+)
+
+// parsePyPIProject parses a project page in either form. Relative file URLs
+// are resolved against base, the URL the page was fetched from.
+func parsePyPIProject(data []byte, base *url.URL) (pypiProject, error) {
+	var doc pypiProject
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return doc, fmt.Errorf("decode project page: %w", err)
+		}
+	} else {
+		doc.Files = parsePyPIAnchors(string(data))
+	}
+	if doc.Meta.APIVersion == "" {
+		doc.Meta.APIVersion = "1.0"
+	}
+	for i := range doc.Files {
+		f := &doc.Files[i]
+		u, err := base.Parse(f.URL)
+		if err != nil {
+			return doc, fmt.Errorf("invalid file URL %q: %w", f.URL, err)
+		}
+		u.Fragment = ""
+		f.URL = u.String()
+		if f.Hashes == nil {
+			f.Hashes = make(map[string]string)
+		}
+		if f.Filename == "" {
+			f.Filename = path.Base(u.Path)
+		}
+	}
+	return doc, nil
+}
+
+// parsePyPIAnchors reads the file links of a PEP 503 HTML page.
+func parsePyPIAnchors(page string) []pypiFile {
+	var files []pypiFile
+	for _, anchor := range htmlAnchor.FindAllStringSubmatch(page, -1) {
+		attrs := make(map[string]string)
+		for _, attr := range htmlAttribute.FindAllStringSubmatch(anchor[1], -1) {
+			attrs[strings.ToLower(attr[1])] = html.UnescapeString(attr[2] + attr[3] + attr[4])
+		}
+		href, ok := attrs["href"]
+		if !ok {
+			continue
+		}
+		f := pypiFile{
+			Filename:       strings.TrimSpace(html.UnescapeString(htmlTag.ReplaceAllString(anchor[2], ""))),
+			Hashes:         make(map[string]string),
+			RequiresPython: attrs["data-requires-python"],
+		}
+		href, fragment, _ := strings.Cut(href, "#")
+		f.URL = href
+		if alg, hex, ok := strings.Cut(fragment, "="); ok {
+			f.Hashes[alg] = hex
+		}
+		for _, name := range []string{"data-core-metadata", "data-dist-info-metadata"} {
+			if value, ok := attrs[name]; ok && len(f.CoreMetadata) == 0 {
+				f.CoreMetadata = parseMetadataAttribute(value)
+			}
+		}
+		if sig, ok := attrs["data-gpg-sig"]; ok {
+			hasSig := sig == "true"
+			f.GPGSig = &hasSig
+		}
+		if reason, ok := attrs["data-yanked"]; ok {
+			f.Yanked = true
+			if reason != "" {
+				f.Yanked = reason
+			}
+		}
+		files = append(files, f)
+	}
+	return files
+}
+
+// parseMetadataAttribute turns a data-core-metadata value, "true" or
+// "<hashname>=<hashvalue>", into its JSON form.
+func parseMetadataAttribute(value string) json.RawMessage {
+	if alg, hex, ok := strings.Cut(value, "="); ok {
+		raw, _ := json.Marshal(map[string]string{alg: hex})
+		return raw
+	}
+	return json.RawMessage(strconv.FormatBool(value == "true"))
+}
+
+// readPyPIProject reads and parses the cached page of project.
+func (c *Cache) readPyPIProject(ctx context.Context, project string) (pypiProject, ObjectInfo, error) {
+	name := pypiProjectPage(project)
+	f, info, err := c.storage.Open(ctx, name)
+	if err != nil {
+		return pypiProject{}, info, err
+	}
+	data, err := io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return pypiProject{}, info, fmt.Errorf("read %q: %w", name, err)
+	}
+	repository := c.upstreamList()[0].URL
+	if meta, err := readMeta(ctx, c.storage, name); err == nil && meta.Repository != "" {
+		repository = meta.Repository
+	}
+	base, err := url.Parse(strings.TrimRight(repository, "/") + "/simple/" + project + "/")
+	if err != nil {
+		return pypiProject{}, info, err
+	}
+	doc, err := parsePyPIProject(data, base)
+	if err != nil {
+		return doc, info, fmt.Errorf("parse %q: %w", name, err)
+	}
+	doc.Name = project
+	return doc, info, nil
+}
+
+// pypiArtifact fills in how to fetch and verify a PyPI download: project
+// pages are requested in the form pip prefers, and files from the URL the
+// cached page links to, checked against the hash it publishes.
+func (c *Cache) pypiArtifact(ap *artifactPath) {
+	dir, file := path.Split(ap.name)
+	project := path.Base(dir)
+	if file == pypiProjectFile {
+		ap.remote = "/simple/" + project + "/"
+		ap.accept = pypiUpstreamAccept
+		ap.unverified = true
+		return
+	}
+
+	var digest expectedDigest
+	ap.remote, digest = c.pypiFile(project, file)
+	ap.digest = &digest
+}
+
+// pypiFile looks up the URL and digest of a file in the cached page of
+// project. It returns an empty URL when the page does not list the file.
+func (c *Cache) pypiFile(project, file string) (string, expectedDigest) {
+	doc, _, err := c.readPyPIProject(context.Background(), project)
+	if err != nil {
+		return "", expectedDigest{}
+	}
+	// A file's PEP 658 metadata is published next to it.
+	distribution, isMetadata := strings.CutSuffix(file, ".metadata")
+	for _, f := range doc.Files {
+		if f.Filename != distribution {
+			continue
+		}
+		if isMetadata {
+			hashes, _ := f.metadataHashes()
+			return f.URL + ".metadata", pypiDigest(hashes)
+		}
+		return f.URL, pypiDigest(f.Hashes)
+	}
+	return "", expectedDigest{}
+}
+
+// pypiVerifiable makes sure the URL and digest of the PyPI file ap are known
+// before it is downloaded. Files are often requested straight from a
+// lockfile, without the project page, or are newer than the cached one, so
+// the page is fetched, or revalidated when cached. Files it still does not
+// list with a hash are refused rather than fetched from a guessed URL and
+// cached unverified.
+func (c *Cache) pypiVerifiable(ctx context.Context, ap *artifactPath) error {
+	if ap.digest == nil || ap.digest.alg != "" {
+		return nil
+	}
+	dir, file := path.Split(ap.name)
+	project := path.Base(dir)
+	page := pypiProjectPage(project)
+	if _, ok := c.lookup(ctx, page); ok {
+		c.revalidate(ctx, page)
+	} else if _, err := c.fetchMetadata(ctx, page); err != nil {
+		return fmt.Errorf("fetch project page for %q: %w", ap.name, err)
+	}
+	if ap.remote, *ap.digest = c.pypiFile(project, file); ap.digest.alg == "" {
+		return fmt.Errorf("verify %q: %w", ap.name, errNotListed)
+	}
+	return nil
+}
+
+// handlePyPIIndex answers project page requests and requests for paths the
+// simple repository API does not define. It reports false for file
+// requests, which are served like any other artifact.
+func (c *Cache) handlePyPIIndex(w http.ResponseWriter, r *http.Request) bool {
+	start := time.Now()
+	project, file, err := parsePyPIPath(r.URL.Path)
+	if err != nil {
+		metrics.HTTPRequestsTotal.WithLabelValues("not_found").Inc()
+		http.Error(w, "not found", http.StatusNotFound)
+		slog.Warn("invalid simple repository request", "path", r.URL.Path, "remote_addr", r.RemoteAddr, "error", err)
+		return true
+	}
+	if file != "" {
+		return false
+	}
+	// PEP 503 lets the index redirect to the normalized project URL.
+	if canonical := "/simple/" + pypiNormalize(project) + "/"; r.URL.Path != canonical {
+		http.Redirect(w, r, c.externalURL(r)+canonical, http.StatusMovedPermanently)
+		return true
+	}
+	contentType, ok := pypiNegotiate(r.Header.Get("Accept"))
+	if !ok {
+		http.Error(w, "not acceptable", http.StatusNotAcceptable)
+		return true
+	}
+
+	name := pypiProjectPage(project)
+	result := "hit"
+	if _, ok := c.lookup(r.Context(), name); ok {
+		metrics.HTTPRequestsTotal.WithLabelValues("hit").Inc()
+		metrics.CacheHitsTotal.Inc()
+		c.revalidateIfStale(r.Context(), name)
+	} else {
+		result = "miss"
+		status, err := c.fetchMetadata(r.Context(), name)
+		if err != nil {
+			http.Error(w, http.StatusText(status), status)
+			slog.Info("artifact request", "result", result, "path", r.URL.Path, "status", status, "remote_addr", r.RemoteAddr, "duration_ms", time.Since(start).Milliseconds())
+			return true
+		}
+	}
+	c.evictor.touch(name)
+
+	if err := c.servePyPIProject(w, r, project, contentType); err != nil {
+		http.Error(w, "failed to read cached project page", http.StatusInternalServerError)
+		slog.Error("artifact request", "result", result, "path", r.URL.Path, "status", http.StatusInternalServerError, "remote_addr", r.RemoteAddr, "error", err)
+		return true
+	}
+	slog.Info("artifact request", "result", result, "path", r.URL.Path, "status", http.StatusOK, "remote_addr", r.RemoteAddr, "duration_ms", time.Since(start).Milliseconds())
+	return true
+}
+
+// pypiNegotiate picks the form of a project page for an Accept header as
+// PEP 691 describes. Clients that send none get text/html.
+func pypiNegotiate(accept string) (string, bool) {
+	if strings.TrimSpace(accept) == "" {
+		return "text/html", true
+	}
+	forms := map[string]string{
+		pypiJSONType: pypiJSONType,
+		"application/vnd.pypi.simple.latest+json": pypiJSONType,
+		pypiHTMLType: pypiHTMLType,
+		"application/vnd.pypi.simple.latest+html": pypiHTMLType,
+		"text/html": "text/html",
+		"*/*":       "text/html",
+	}
+	best, bestQ := "", 0.0
+	for _, item := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(item)
+		if err != nil {
+			continue
+		}
+		form, ok := forms[mediaType]
+		if !ok {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if q > bestQ {
+			best, bestQ = form, q
+		}
+	}
+	return best, best != ""
+}
+
+// servePyPIProject answers with the cached page of project in the requested
+// form, its file links pointing back at the cache.
+func (c *Cache) servePyPIProject(w http.ResponseWriter, r *http.Request, project, contentType string) error {
+	doc, info, err := c.readPyPIProject(r.Context(), project)
+	if err != nil {
+		return err
+	}
+	base := c.externalURL(r) + "/packages/" + project + "/"
+	for i := range doc.Files {
+		f := &doc.Files[i]
+		f.URL = base + url.PathEscape(f.Filename)
+		if len(f.CoreMetadata) == 0 {
+			f.CoreMetadata = f.DistInfoMetadata
+		}
+		f.DistInfoMetadata = f.CoreMetadata
+	}
+
+	var buf bytes.Buffer
+	if contentType == pypiJSONType {
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(doc); err != nil {
+			return fmt.Errorf("encode project page %q: %w", project, err)
+		}
+	} else {
+		writePyPIHTML(&buf, doc)
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Add("Vary", "Accept")
+	http.ServeContent(w, r, "", info.ModTime, bytes.NewReader(buf.Bytes()))
+	return nil
+}
+
+// writePyPIHTML renders a project page in the HTML form of PEP 503.
+func writePyPIHTML(buf *bytes.Buffer, doc pypiProject) {
+	esc := html.EscapeString
+	fmt.Fprintf(buf, "<!DOCTYPE html>\n<html>\n  <head>\n    <meta name=\"pypi:repository-version\" content=\"%s\">\n", esc(doc.Meta.APIVersion))
+	fmt.Fprintf(buf, "    <title>Links for %s</title>\n  </head>\n  <body>\n    <h1>Links for %s</h1>\n", esc(doc.Name), esc(doc.Name))
+	for _, f := range doc.Files {
+		href := f.URL
+		if digest := pypiDigest(f.Hashes); digest.alg != "" {
+			href += "#" + digest.alg + "=" + digest.hex
+		}
+		fmt.Fprintf(buf, "    <a href=\"%s\"", esc(href))
+		if f.RequiresPython != "" {
+			fmt.Fprintf(buf, " data-requires-python=\"%s\"", esc(f.RequiresPython))
+		}
+		if hashes, ok := f.metadataHashes(); ok {
+			value := "true"
+			if digest := pypiDigest(hashes); digest.alg != "" {
+				value = digest.alg + "=" + digest.hex
+			}
+			fmt.Fprintf(buf, " data-core-metadata=\"%s\" data-dist-info-metadata=\"%s\"", value, value)
+		}
+		if f.GPGSig != nil {
+			fmt.Fprintf(buf, " data-gpg-sig=\"%t\"", *f.GPGSig)
+		}
+		switch yanked := f.Yanked.(type) {
+		case bool:
+			if yanked {
+				buf.WriteString(` data-yanked=""`)
+			}
+		case string:
+			fmt.Fprintf(buf, " data-yanked=\"%s\"", esc(yanked))
+		}
+		fmt.Fprintf(buf, ">%s</a><br/>\n", esc(f.Filename))
+	}
+	buf.WriteString("  </body>\n</html>\n")
+}
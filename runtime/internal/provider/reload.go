@@ -0,0 +1,79 @@
+package provider
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Settings are the parts of a cache's configuration that can change while it
+// serves requests.
+type Settings struct {
+	Upstreams      []Upstream
+	MissMode       MissMode
+	NegativeTTL    time.Duration
+	ChecksumPolicy ChecksumPolicy
+	Policy         Policy
+	// MaxSize and the watermarks resize a cache that was started with
+	// eviction enabled. Turning eviction on or off takes a restart.
+	MaxSize   int64
+	EvictHigh float64
+	EvictLow  float64
+	// Hosted lists the path prefixes clients upload to; see SetHosted.
+	Hosted []string
+	// Retry and Breaker say how upstream failures are retried and when
+	// upstreams are given a rest.
+	Retry   RetryPolicy
+	Breaker BreakerPolicy
+}
+
+// Validate checks s without applying it, so that settings for several caches
+// can be checked before any of them changes.
+func (s Settings) Validate() error {
+	if len(s.Upstreams) == 0 && len(s.Hosted) == 0 {
+		return errors.New("no upstream repositories")
+	}
+	for _, u := range s.Upstreams {
+		if err := u.Validate(); err != nil {
+			return err
+		}
+	}
+	if err := validateHosted(s.Hosted); err != nil {
+		return err
+	}
+	if err := s.Retry.validate(); err != nil {
+		return err
+	}
+	if err := s.Breaker.validate(); err != nil {
+		return err
+	}
+	if s.MaxSize > 0 && (s.EvictLow <= 0 || s.EvictHigh > 1 || s.EvictLow >= s.EvictHigh) {
+		return fmt.Errorf("invalid eviction watermarks %.2f/%.2f (expected 0 < low < high <= 1)", s.EvictLow, s.EvictHigh)
+	}
+	return nil
+}
+
+// Reconfigure applies s to a running cache. Downloads in flight finish with
+// the upstream they started from; requests arriving afterwards see the new
+// settings. Nothing is changed when s is invalid.
+func (c *Cache) Reconfigure(s Settings) error {
+	if err := s.Validate(); err != nil {
+		return err
+	}
+	c.SetUpstreams(s.Upstreams)
+	c.SetMissMode(s.MissMode)
+	c.negatives.setTTL(s.NegativeTTL)
+	c.SetChecksumPolicy(s.ChecksumPolicy)
+	c.SetPolicy(s.Policy)
+	c.SetHosted(s.Hosted)
+	c.SetRetryPolicy(s.Retry)
+	c.SetBreakerPolicy(s.Breaker)
+	switch {
+	case c.evictor != nil && s.MaxSize > 0:
+		c.evictor.setLimits(s.MaxSize, s.EvictHigh, s.EvictLow)
+	case (c.evictor != nil) != (s.MaxSize > 0):
+		slog.Warn("enabling or disabling eviction takes a restart; keeping the current setting")
+	}
+	return nil
+}
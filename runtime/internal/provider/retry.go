@@ -0,0 +1,140 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"articache/internal/metrics"
+)
+
+// RetryPolicy controls how the built-in HTTP downloader retries downloads
+// that failed for reasons likely to go away: 5xx and 429 answers, timeouts
+// and dropped connections.
+type RetryPolicy struct {
+	// Attempts is how many times a download is tried in all; 1 or less
+	// disables retries.
+	Attempts int
+	// Backoff is the delay before the first retry, doubled for each further
+	// retry up to MaxBackoff. Delays are jittered so that clients failing
+	// together do not retry together.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryPolicy tries downloads three times, waiting about 200ms and
+// then 400ms in between.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{Attempts: 3, Backoff: 200 * time.Millisecond, MaxBackoff: 5 * time.Second}
+}
+
+func (p RetryPolicy) validate() error {
+	if p.Backoff < 0 || p.MaxBackoff < 0 {
+		return fmt.Errorf("invalid retry backoff %s/%s (expected durations of zero or more)", p.Backoff, p.MaxBackoff)
+	}
+	return nil
+}
+
+// delay returns how long to wait before retry number n, counting from 1:
+// the exponential backoff with equal jitter, so between half of it and all
+// of it.
+func (p RetryPolicy) delay(n int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < n && (p.MaxBackoff <= 0 || d < p.MaxBackoff); i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+// SetRetryPolicy sets how the built-in HTTP downloader retries downloads.
+func (c *Cache) SetRetryPolicy(p RetryPolicy) {
+	if d, ok := c.downloader.(*HTTPDownloader); ok {
+		d.retryPolicy.Store(&p)
+	}
+}
+
+func (d *HTTPDownloader) retries() RetryPolicy {
+	if p := d.retryPolicy.Load(); p != nil {
+		return *p
+	}
+	return DefaultRetryPolicy()
+}
+
+// statusError is an unexpected answer from upstream to the request op made.
+type statusError struct {
+	op     string
+	url    string
+	status int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s %q: unexpected status %d", e.op, e.url, e.status)
+}
+
+// transient reports whether err is worth retrying: a 5xx or 429 answer, a
+// timeout or a connection dropped by upstream.
+func transient(err error) bool {
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.status >= http.StatusInternalServerError || se.status == http.StatusTooManyRequests
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, syscall.EPIPE) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// retry calls try until it succeeds, fails for good, or the attempts of the
+// retry policy are used up, waiting between attempts. Once started reports
+// true, part of the response has reached a client and nothing is retried.
+func (d *HTTPDownloader) retry(ctx context.Context, try func() error, started func() bool) error {
+	policy := d.retries()
+	for attempt := 1; ; attempt++ {
+		err := try()
+		if err == nil || attempt >= policy.Attempts || !transient(err) || started() || ctx.Err() != nil {
+			return err
+		}
+		delay := policy.delay(attempt)
+		slog.Info("retrying upstream download", "attempt", attempt+1, "delay_ms", delay.Milliseconds(), "error", err)
+		metrics.DownloadRetriesTotal.Inc()
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+	}
+}
+
+// startedWriter records whether a response was started on the wrapped
+// ResponseWriter.
+type startedWriter struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (sw *startedWriter) WriteHeader(code int) {
+	sw.started = true
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *startedWriter) Write(p []byte) (int, error) {
+	sw.started = true
+	return sw.ResponseWriter.Write(p)
+}
@@ -0,0 +1,85 @@
+package provider
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Allows reports whether the upstream may serve name according to its include
+// and exclude patterns. An upstream without include patterns serves every path
+// that is not excluded.
+func (u Upstream) Allows(name string) bool {
+	for _, pattern := range u.Exclude {
+		if matchGlob(pattern, name) {
+			return false
+		}
+	}
+	if len(u.Include) == 0 {
+		return true
+	}
+	for _, pattern := range u.Include {
+		if matchGlob(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the upstream's routing patterns.
+func (u Upstream) Validate() error {
+	for _, pattern := range append(append([]string{}, u.Include...), u.Exclude...) {
+		if err := validateGlob(pattern); err != nil {
+			return fmt.Errorf("upstream %q: %w", u.Name, err)
+		}
+	}
+	return nil
+}
+
+func validateGlob(pattern string) error {
+	for _, segment := range globSegments(pattern) {
+		if segment == "**" {
+			continue
+		}
+		if _, err := path.Match(segment, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// matchGlob matches a slash separated artifact path against a pattern. Within
+// a segment the path.Match syntax applies; a "**" segment matches any number of
+// segments, including none.
+func matchGlob(pattern, name string) bool {
+	return matchSegments(globSegments(pattern), globSegments(name))
+}
+
+func globSegments(s string) []string {
+	s = strings.Trim(s, "/")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "/")
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := len(name); i >= 0; i-- {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
@@ -0,0 +1,308 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Storage persists cached artifacts. Names are clean slash-separated artifact
+// paths such as "/org/example/lib/1.0/lib-1.0.jar". Missing objects are
+// reported with an error matching fs.ErrNotExist.
+type Storage interface {
+	Stat(ctx context.Context, name string) (ObjectInfo, error)
+	Open(ctx context.Context, name string) (io.ReadSeekCloser, ObjectInfo, error)
+	// Put stores the contents of r under name atomically: readers observe
+	// either the previous object or the complete new one. If reading r fails,
+	// nothing is stored and the read error is returned wrapped.
+	Put(ctx context.Context, name string, r io.Reader) error
+	Delete(ctx context.Context, name string) error
+	// List calls fn for every object whose name starts with the directory
+	// prefix, or for the object named prefix itself.
+	List(ctx context.Context, prefix string, fn func(ObjectInfo) error) error
+}
+
+// Presigner is implemented by storage backends that can hand out short-lived
+// URLs through which clients fetch an object directly.
+type Presigner interface {
+	PresignGet(ctx context.Context, name string, expiry time.Duration) (string, error)
+}
+
+// Creator is implemented by storage backends that can store an object only if
+// none exists under its name, in a single step. Create otherwise behaves like
+// Put and fails with fs.ErrExist when the object exists.
+type Creator interface {
+	Create(ctx context.Context, name string, r io.Reader) error
+}
+
+// Pruner is implemented by storage backends that keep directories, which
+// deleting objects may leave empty. Prune removes the empty directories below
+// prefix, and prefix and its parents once they are empty.
+type Pruner interface {
+	Prune(ctx context.Context, prefix string) error
+}
+
+// ObjectInfo describes a stored object.
+type ObjectInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// SetStorage replaces the default filesystem storage below the cache path.
+// Local state such as the persisted negative cache stays under the cache
+// path. It must be called before Start.
+func (c *Cache) SetStorage(s Storage) {
+	c.storage = s
+	if c.evictor != nil {
+		c.evictor.store = s
+	}
+}
+
+// SetPresignHits makes cache hits redirect to a presigned storage URL valid
+// for expiry instead of streaming the object. Clients whose User-Agent
+// contains one of noRedirectAgents are known not to follow redirects and are
+// still served the bytes. A zero expiry disables presigning. It must be
+// called after SetStorage and before Start.
+func (c *Cache) SetPresignHits(expiry time.Duration, noRedirectAgents []string) error {
+	if expiry <= 0 {
+		c.presignExpiry = 0
+		return nil
+	}
+	if _, ok := c.storage.(Presigner); !ok {
+		return errors.New("storage backend cannot presign URLs")
+	}
+	if expiry < time.Second || expiry > 7*24*time.Hour {
+		return fmt.Errorf("invalid presign expiry %s (expected 1s to 168h)", expiry)
+	}
+	c.presignExpiry = expiry
+	c.noRedirectAgents = nil
+	for _, agent := range noRedirectAgents {
+		if agent = strings.ToLower(strings.TrimSpace(agent)); agent != "" {
+			c.noRedirectAgents = append(c.noRedirectAgents, agent)
+		}
+	}
+	return nil
+}
+
+// redirectHit answers a hit with a redirect to a presigned URL of the stored
+// object when presigning is enabled and the client follows redirects. It
+// reports whether it did.
+func (c *Cache) redirectHit(w http.ResponseWriter, r *http.Request, name string) bool {
+	if c.presignExpiry <= 0 {
+		return false
+	}
+	p, ok := c.storage.(Presigner)
+	if !ok {
+		return false
+	}
+	agent := strings.ToLower(r.UserAgent())
+	for _, noRedirect := range c.noRedirectAgents {
+		if strings.Contains(agent, noRedirect) {
+			return false
+		}
+	}
+	presigned, err := p.PresignGet(r.Context(), name, c.presignExpiry)
+	if err != nil {
+		slog.Warn("failed to presign cached artifact; serving it directly", "artifact", name, "error", err)
+		return false
+	}
+	http.Redirect(w, r, presigned, http.StatusTemporaryRedirect)
+	return true
+}
+
+// FileStorage stores artifacts as files below a root directory.
+type FileStorage struct {
+	root string
+}
+
+func NewFileStorage(root string) *FileStorage {
+	return &FileStorage{root: filepath.Clean(root)}
+}
+
+// filePath maps an object name to a path below the root, refusing names that
+// would escape it.
+func (s *FileStorage) filePath(name string) (string, error) {
+	rel := strings.TrimPrefix(path.Clean("/"+name), "/")
+	if rel == "" {
+		return s.root, nil
+	}
+	fullPath := filepath.Join(s.root, filepath.FromSlash(rel))
+	relCheck, err := filepath.Rel(s.root, fullPath)
+	if err != nil {
+		return "", fmt.Errorf("compute relative path: %w", err)
+	}
+	if relCheck == ".." || strings.HasPrefix(relCheck, ".."+string(filepath.Separator)) {
+		return "", errors.New("invalid object name")
+	}
+	return fullPath, nil
+}
+
+func (s *FileStorage) Stat(ctx context.Context, name string) (ObjectInfo, error) {
+	filePath, err := s.filePath(name)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if info.IsDir() {
+		return ObjectInfo{}, fmt.Errorf("stat %q: %w", name, fs.ErrNotExist)
+	}
+	return ObjectInfo{Name: name, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (s *FileStorage) Open(ctx context.Context, name string) (io.ReadSeekCloser, ObjectInfo, error) {
+	filePath, err := s.filePath(name)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		f.Close()
+		return nil, ObjectInfo{}, fmt.Errorf("open %q: %w", name, fs.ErrNotExist)
+	}
+	return f, ObjectInfo{Name: name, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (s *FileStorage) Put(ctx context.Context, name string, r io.Reader) error {
+	return s.store(name, r, os.Rename)
+}
+
+// Create stores r under name unless a file exists there. A hard link, unlike
+// a rename, never replaces its target.
+func (s *FileStorage) Create(ctx context.Context, name string, r io.Reader) error {
+	return s.store(name, r, os.Link)
+}
+
+// store writes r to a temp file next to the file of name and moves it into
+// place with place.
+func (s *FileStorage) store(name string, r io.Reader, place func(oldpath, newpath string) error) error {
+	filePath, err := s.filePath(name)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(filePath)
+	var tmp *os.File
+	for attempt := 0; ; attempt++ {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return fmt.Errorf("mkdir %q: %w", dir, err)
+		}
+		tmp, err = os.CreateTemp(dir, filepath.Base(filePath)+".*.tmp")
+		// A concurrent Prune may remove dir before the temp file is in it.
+		if err == nil || attempt > 0 || !errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("create temp file: %w", err)
+	}
+	tmpName := tmp.Name()
+	defer func() {
+		_ = tmp.Close()
+		_ = os.Remove(tmpName)
+	}()
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		return fmt.Errorf("write %q: %w", tmpName, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close %q: %w", tmpName, err)
+	}
+	if err := place(tmpName, filePath); err != nil {
+		return fmt.Errorf("move %q -> %q: %w", tmpName, filePath, err)
+	}
+	return nil
+}
+
+func (s *FileStorage) Delete(ctx context.Context, name string) error {
+	filePath, err := s.filePath(name)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(filePath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s *FileStorage) Prune(ctx context.Context, prefix string) error {
+	root, err := s.filePath(prefix)
+	if err != nil {
+		return err
+	}
+	var dirs []string
+	err = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			dirs = append(dirs, p)
+		}
+		return ctx.Err()
+	})
+	if err != nil {
+		return err
+	}
+	// Children come after their parents in walk order. Directories that are
+	// not empty stay.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if dirs[i] != s.root {
+			_ = os.Remove(dirs[i])
+		}
+	}
+	for dir := filepath.Dir(root); dir != s.root && strings.HasPrefix(dir, s.root); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *FileStorage) List(ctx context.Context, prefix string, fn func(ObjectInfo) error) error {
+	root, err := s.filePath(prefix)
+	if err != nil {
+		return err
+	}
+	return filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return ctx.Err()
+		}
+		// Skip uploads still in progress.
+		if strings.HasSuffix(d.Name(), ".tmp") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(s.root, p)
+		if err != nil {
+			return err
+		}
+		return fn(ObjectInfo{Name: "/" + filepath.ToSlash(rel), Size: info.Size(), ModTime: info.ModTime()})
+	})
+}
@@ -0,0 +1,441 @@
+package provider
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3Config configures an S3-compatible storage backend (AWS S3, MinIO, Ceph
+// RGW, ...).
+type S3Config struct {
+	// Endpoint is the base URL of the service, e.g. https://s3.eu-west-1.amazonaws.com
+	// or http://minio:9000.
+	Endpoint string
+	Bucket   string
+	Region   string
+	// Prefix is prepended to every object key, so that several caches can
+	// share a bucket.
+	Prefix       string
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	// PathStyle addresses the bucket as a path segment instead of a virtual
+	// host, as MinIO and most self-hosted services expect.
+	PathStyle bool
+}
+
+// S3Storage stores artifacts as objects in an S3-compatible bucket. Requests
+// are signed with AWS Signature Version 4.
+type S3Storage struct {
+	cfg        S3Config
+	endpoint   *url.URL
+	prefix     string
+	httpClient *http.Client
+}
+
+func NewS3Storage(cfg S3Config) (*S3Storage, error) {
+	endpoint, err := url.Parse(strings.TrimRight(cfg.Endpoint, "/"))
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", cfg.Endpoint)
+	}
+	if cfg.Bucket == "" {
+		return nil, errors.New("S3 bucket is required")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	prefix := strings.Trim(cfg.Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &S3Storage{
+		cfg:        cfg,
+		endpoint:   endpoint,
+		prefix:     prefix,
+		httpClient: &http.Client{Timeout: 5 * time.Minute},
+	}, nil
+}
+
+func (s *S3Storage) key(name string) string {
+	return s.prefix + strings.TrimPrefix(name, "/")
+}
+
+func (s *S3Storage) name(key string) string {
+	return "/" + strings.TrimPrefix(key, s.prefix)
+}
+
+// objectURL returns the URL of key, or of the bucket itself when key is empty.
+func (s *S3Storage) objectURL(key string) *url.URL {
+	u := *s.endpoint
+	objectPath := "/" + key
+	if s.cfg.PathStyle {
+		objectPath = "/" + s.cfg.Bucket + objectPath
+	} else {
+		u.Host = s.cfg.Bucket + "." + u.Host
+	}
+	u.Path = strings.TrimRight(s.endpoint.Path, "/") + objectPath
+	u.RawPath = s3Escape(u.Path)
+	return &u
+}
+
+// emptyPayloadHash is the SHA-256 of an empty body.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+func (s *S3Storage) do(ctx context.Context, method string, u *url.URL, query map[string]string, body io.Reader, size int64, payloadHash string, header http.Header) (*http.Response, error) {
+	u.RawQuery = s3CanonicalQuery(query)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	s.sign(req, payloadHash, time.Now().UTC())
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("s3 %s %q: %w", method, u.Path, err)
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		switch resp.StatusCode {
+		case http.StatusNotFound:
+			return nil, fmt.Errorf("s3 %s %q: %w", method, u.Path, fs.ErrNotExist)
+		case http.StatusPreconditionFailed:
+			return nil, fmt.Errorf("s3 %s %q: %w", method, u.Path, fs.ErrExist)
+		}
+		return nil, fmt.Errorf("s3 %s %q: unexpected status %d: %s", method, u.Path, resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+func (s *S3Storage) Stat(ctx context.Context, name string) (ObjectInfo, error) {
+	resp, err := s.do(ctx, http.MethodHead, s.objectURL(s.key(name)), nil, nil, 0, emptyPayloadHash, nil)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	resp.Body.Close()
+	return objectInfoFromHeader(name, resp), nil
+}
+
+func objectInfoFromHeader(name string, resp *http.Response) ObjectInfo {
+	info := ObjectInfo{Name: name, Size: resp.ContentLength}
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.ModTime = t
+	}
+	return info
+}
+
+func (s *S3Storage) Open(ctx context.Context, name string) (io.ReadSeekCloser, ObjectInfo, error) {
+	info, err := s.Stat(ctx, name)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	return &s3Object{s: s, ctx: ctx, key: s.key(name), size: info.Size}, info, nil
+}
+
+func (s *S3Storage) Put(ctx context.Context, name string, r io.Reader) error {
+	return s.put(ctx, name, r, nil)
+}
+
+// Create stores r under name with a conditional write, which the bucket
+// refuses when the object exists.
+func (s *S3Storage) Create(ctx context.Context, name string, r io.Reader) error {
+	return s.put(ctx, name, r, http.Header{"If-None-Match": {"*"}})
+}
+
+func (s *S3Storage) put(ctx context.Context, name string, r io.Reader, header http.Header) error {
+	// S3 needs the length and digest of the body up front, so it is spooled
+	// to a local temp file first. A failed read never reaches the bucket.
+	tmp, err := os.CreateTemp("", "articache-s3-*.tmp")
+	if err != nil {
+		return fmt.Errorf("create temp file: %w", err)
+	}
+	defer func() {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+	}()
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), r)
+	if err != nil {
+		return fmt.Errorf("write %q: %w", tmp.Name(), err)
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("rewind %q: %w", tmp.Name(), err)
+	}
+
+	resp, err := s.do(ctx, http.MethodPut, s.objectURL(s.key(name)), nil, tmp, size, hex.EncodeToString(h.Sum(nil)), header)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3Storage) Delete(ctx context.Context, name string) error {
+	resp, err := s.do(ctx, http.MethodDelete, s.objectURL(s.key(name)), nil, nil, 0, emptyPayloadHash, nil)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+type s3ListResult struct {
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+	Contents              []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+}
+
+func (s *S3Storage) List(ctx context.Context, prefix string, fn func(ObjectInfo) error) error {
+	keyPrefix := s.prefix
+	if trimmed := strings.Trim(prefix, "/"); trimmed != "" {
+		// A prefix may name a single object as well as a "directory".
+		if info, err := s.Stat(ctx, prefix); err == nil {
+			if err := fn(info); err != nil {
+				return err
+			}
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		keyPrefix += trimmed + "/"
+	}
+
+	token := ""
+	for {
+		query := map[string]string{"list-type": "2", "prefix": keyPrefix}
+		if token != "" {
+			query["continuation-token"] = token
+		}
+		resp, err := s.do(ctx, http.MethodGet, s.objectURL(""), query, nil, 0, emptyPayloadHash, nil)
+		if err != nil {
+			return err
+		}
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("decode S3 listing: %w", err)
+		}
+		for _, obj := range result.Contents {
+			if err := fn(ObjectInfo{Name: s.name(obj.Key), Size: obj.Size, ModTime: obj.LastModified}); err != nil {
+				return err
+			}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// PresignGet returns a URL through which the object name can be downloaded
+// without credentials until expiry passes.
+func (s *S3Storage) PresignGet(ctx context.Context, name string, expiry time.Duration) (string, error) {
+	return s.presign(s.objectURL(s.key(name)), expiry, time.Now().UTC()), nil
+}
+
+// presign signs a GET of u with query parameters, as Signature Version 4
+// does for presigned URLs.
+func (s *S3Storage) presign(u *url.URL, expiry time.Duration, now time.Time) string {
+	amzDate := now.Format("20060102T150405Z")
+	scope := now.Format("20060102") + "/" + s.cfg.Region + "/s3/aws4_request"
+	query := map[string]string{
+		"X-Amz-Algorithm":     "AWS4-HMAC-SHA256",
+		"X-Amz-Credential":    s.cfg.AccessKey + "/" + scope,
+		"X-Amz-Date":          amzDate,
+		"X-Amz-Expires":       strconv.FormatInt(int64(expiry/time.Second), 10),
+		"X-Amz-SignedHeaders": "host",
+	}
+	if s.cfg.SessionToken != "" {
+		query["X-Amz-Security-Token"] = s.cfg.SessionToken
+	}
+	u.RawQuery = s3CanonicalQuery(query)
+
+	canonicalRequest := strings.Join([]string{
+		http.MethodGet,
+		u.EscapedPath(),
+		u.RawQuery,
+		"host:" + u.Host + "\n",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	u.RawQuery += "&X-Amz-Signature=" + s.signature(now, scope, amzDate, canonicalRequest)
+	return u.String()
+}
+
+// s3Object reads an object with ranged GET requests, opening a new one only
+// when the read position moves, so it can back http.ServeContent.
+type s3Object struct {
+	s    *S3Storage
+	ctx  context.Context
+	key  string
+	size int64
+	pos  int64
+	body io.ReadCloser
+}
+
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.pos >= o.size {
+		return 0, io.EOF
+	}
+	if o.body == nil {
+		header := http.Header{"Range": {fmt.Sprintf("bytes=%d-", o.pos)}}
+		resp, err := o.s.do(o.ctx, http.MethodGet, o.s.objectURL(o.key), nil, nil, 0, emptyPayloadHash, header)
+		if err != nil {
+			return 0, err
+		}
+		if resp.StatusCode != http.StatusPartialContent && o.pos != 0 {
+			resp.Body.Close()
+			return 0, fmt.Errorf("s3 GET %q: range not honored (status %d)", o.key, resp.StatusCode)
+		}
+		o.body = resp.Body
+	}
+	n, err := o.body.Read(p)
+	o.pos += int64(n)
+	return n, err
+}
+
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = o.pos + offset
+	case io.SeekEnd:
+		pos = o.size + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if pos < 0 {
+		return 0, errors.New("negative position")
+	}
+	if pos != o.pos && o.body != nil {
+		o.body.Close()
+		o.body = nil
+	}
+	o.pos = pos
+	return pos, nil
+}
+
+func (o *s3Object) Close() error {
+	if o.body != nil {
+		return o.body.Close()
+	}
+	return nil
+}
+
+// sign adds AWS Signature Version 4 headers to req.
+func (s *S3Storage) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.cfg.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.cfg.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		if lk := strings.ToLower(k); strings.HasPrefix(lk, "x-amz-") || lk == "range" {
+			headers[lk] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := now.Format("20060102") + "/" + s.cfg.Region + "/s3/aws4_request"
+	signature := s.signature(now, scope, amzDate, canonicalRequest)
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.cfg.AccessKey, scope, signedHeaders, signature))
+}
+
+func (s *S3Storage) signature(now time.Time, scope, amzDate, canonicalRequest string) string {
+	digest := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(digest[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.cfg.SecretKey), now.Format("20060102"))
+	key = hmacSHA256(key, s.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape URI-encodes every byte of p except unreserved characters and '/',
+// as Signature Version 4 requires.
+func s3Escape(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		ch := p[i]
+		if ch == '/' || ch == '-' || ch == '_' || ch == '.' || ch == '~' ||
+			('a' <= ch && ch <= 'z') || ('A' <= ch && ch <= 'Z') || ('0' <= ch && ch <= '9') {
+			b.WriteByte(ch)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", ch)
+	}
+	return b.String()
+}
+
+func s3CanonicalQuery(query map[string]string) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, strings.ReplaceAll(s3Escape(k), "/", "%2F")+"="+strings.ReplaceAll(s3Escape(query[k]), "/", "%2F"))
+	}
+	return strings.Join(parts, "&")
+}
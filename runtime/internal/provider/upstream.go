@@ -0,0 +1,175 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strings"
+)
+
+// Upstream is a remote repository the cache resolves artifacts from.
+type Upstream struct {
+	Name string
+	URL  string
+	// Include and Exclude are glob patterns ("/com/example/**") restricting
+	// which artifact paths are resolved against this upstream.
+	Include []string
+	Exclude []string
+	// Credentials, when set, authenticate requests to the upstream.
+	Credentials *Credentials
+}
+
+// ParseUpstream parses an upstream given as "[name=]url". Without an explicit
+// name the host of the URL is used. User information in the URL becomes the
+// upstream's basic auth credentials.
+func ParseUpstream(s string) (Upstream, error) {
+	name, rawURL, found := strings.Cut(strings.TrimSpace(s), "=")
+	if !found || strings.Contains(name, "/") {
+		name, rawURL = "", strings.TrimSpace(s)
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return Upstream{}, fmt.Errorf("invalid repository URL %q", redactURL(rawURL))
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return Upstream{}, fmt.Errorf("invalid repository URL %q (expected http or https URL)", u.Redacted())
+	}
+	var creds *Credentials
+	if u.User != nil {
+		password, _ := u.User.Password()
+		creds = &Credentials{Username: u.User.Username(), Password: password}
+		u.User = nil
+		rawURL = u.String()
+	}
+	if name == "" {
+		name = upstreamName(rawURL)
+	}
+	return Upstream{Name: name, URL: strings.TrimRight(rawURL, "/"), Credentials: creds}, nil
+}
+
+// Prober is implemented by downloaders that can check whether an upstream has
+// an artifact without downloading it.
+type Prober interface {
+	Exists(ctx context.Context, ap artifactPath) (bool, error)
+}
+
+// SetUpstreams replaces the ordered list of upstream repositories. Misses are
+// resolved against them in order.
+func (c *Cache) SetUpstreams(upstreams []Upstream) {
+	list := make([]Upstream, len(upstreams))
+	for i, u := range upstreams {
+		u.URL = strings.TrimRight(u.URL, "/")
+		list[i] = u
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.upstreams = list
+}
+
+// upstreamList returns the current upstreams. The slice is replaced, never
+// modified, when they change.
+func (c *Cache) upstreamList() []Upstream {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.upstreams
+}
+
+// candidates returns the upstreams that may still serve name, in order,
+// leaving out those not routed to it, those known not to have it and those
+// whose circuit breaker blocks requests. Hosted artifacts have none. Callers
+// ask the breakers to allow each request before sending it, so that a trial
+// request is only let through to an upstream that is actually tried.
+func (c *Cache) candidates(name string) []Upstream {
+	if c.isHosted(name) {
+		return nil
+	}
+	upstreams := c.upstreamList()
+	out := make([]Upstream, 0, len(upstreams))
+	for _, u := range upstreams {
+		if !u.Allows(name) || c.negatives.has(u.URL, name) || c.breakers.blocked(u) {
+			continue
+		}
+		out = append(out, u)
+	}
+	return out
+}
+
+// routed reports whether ap.repository is an upstream that may serve ap.name.
+func (c *Cache) routed(ap artifactPath) bool {
+	for _, u := range c.upstreamList() {
+		if u.URL == strings.TrimRight(ap.repository, "/") && u.Allows(ap.name) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve calls try for each candidate upstream in order until one succeeds.
+// Upstreams answering ErrNotFound are remembered as not having the artifact.
+// It returns ErrNotFound when no upstream has the artifact, and
+// errCircuitOpen when those that might are held back by their breakers.
+func (c *Cache) resolve(name string, try func(ap artifactPath) error) error {
+	var lastErr error
+	for _, u := range c.candidates(name) {
+		if !c.breakers.allow(u) {
+			continue
+		}
+		err := try(c.artifact(name, u.URL))
+		if err == nil {
+			return nil
+		}
+		if errors.Is(err, errResponseStarted) {
+			return err
+		}
+		if errors.Is(err, ErrNotFound) {
+			c.negatives.add(u.URL, name)
+			continue
+		}
+		lastErr = err
+	}
+	if lastErr != nil {
+		return lastErr
+	}
+	if c.circuitOpen(name) {
+		return fmt.Errorf("resolve %q: %w", name, errCircuitOpen)
+	}
+	return fmt.Errorf("resolve %q: %w", name, ErrNotFound)
+}
+
+// locate picks the upstream a redirected client should be sent to. With more
+// than one candidate the upstreams are probed in order when the downloader
+// supports it; otherwise the first candidate is used. It reports false when no
+// upstream has the artifact.
+func (c *Cache) locate(ctx context.Context, name string) (Upstream, bool) {
+	candidates := c.candidates(name)
+	prober, ok := c.downloader.(Prober)
+	var fallback *Upstream
+	for i, u := range candidates {
+		if !c.breakers.allow(u) {
+			continue
+		}
+		if len(candidates) == 1 || !ok {
+			return u, true
+		}
+		exists, err := prober.Exists(ctx, c.artifact(name, u.URL))
+		c.observeUpstream(u.URL, err)
+		if err != nil {
+			slog.Warn("upstream probe failed", "artifact", name, "repository", u.Name, "error", err)
+			if fallback == nil {
+				fallback = &candidates[i]
+			}
+			continue
+		}
+		if exists {
+			return u, true
+		}
+		c.negatives.add(u.URL, name)
+	}
+	if fallback != nil {
+		return *fallback, true
+	}
+	return Upstream{}, false
+}
@@ -1,15 +1,25 @@
 package main
 
 import (
+	"articache/internal/access"
 	"articache/internal/logging"
 	"articache/internal/metrics"
 	"articache/internal/provider"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"path"
+	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
@@ -18,48 +28,180 @@ import (
 )
 
 func main() {
-	addrPtr := flag.String("addr", ":8080", "Artifact HTTP listen address.")
-	maintenanceAddrPtr := flag.String("maintenance-addr", ":8081", "Maintenance HTTP listen address (healthz/metrics).")
-	pathPtr := flag.String("path", "/tmp/articache_data", "Cache path.")
-	repoPtr := flag.String("repo", "https://repo.maven.apache.org/maven2", "Main remote repository.")
-	workersPtr := flag.Int("workers", 20, "Number of background download workers.")
-	logLevelPtr := flag.String("log-level", "info", "Log level: debug, info, warn, error.")
-	logFormatPtr := flag.String("log-format", "json", "Log format: json or text.")
-	flag.Parse()
-
-	if err := logging.Init(*logLevelPtr, *logFormatPtr); err != nil {
+	cfg, err := loadConfig(os.Args[1:], os.Stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		slog.Error("invalid configuration", "error", err)
+		os.Exit(2)
+	}
+
+	if err := logging.Init(cfg.LogLevel, cfg.LogFormat); err != nil {
 		slog.Error("invalid logging configuration", "error", err)
 		os.Exit(2)
 	}
 
+	s3Config := provider.S3Config{
+		Endpoint:     cfg.S3Endpoint,
+		Bucket:       cfg.S3Bucket,
+		Region:       cfg.S3Region,
+		Prefix:       cfg.S3Prefix,
+		PathStyle:    cfg.S3PathStyle,
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+
 	slog.Info("starting articache",
-		"addr", *addrPtr,
-		"maintenance_addr", *maintenanceAddrPtr,
-		"cache_path", *pathPtr,
-		"repo", *repoPtr,
-		"workers", *workersPtr,
+		"config", cfg.ConfigFile,
+		"addr", cfg.Addr,
+		"maintenance_addr", cfg.MaintenanceAddr,
+		"cache_path", cfg.Path,
+		"storage", cfg.Storage,
+		"presign_hits", cfg.PresignHits.String(),
+		"repos", upstreamURLs(cfg.upstreams),
+		"workers", cfg.Workers,
+		"miss_mode", cfg.missMode.String(),
+		"negative_ttl", cfg.NegativeTTL.String(),
+		"max_size_bytes", cfg.maxSize,
+		"metadata_max_age", cfg.MetadataMaxAge.String(),
+		"snapshot_max_age", cfg.SnapshotMaxAge.String(),
+		"checksum_policy", cfg.checksumPolicy.String(),
+		"npm_registry", upstreamURLs(cfg.npmUpstreams),
+		"go_proxy", upstreamURLs(cfg.goUpstreams),
+		"go_sumdb", cfg.GoSumDB,
+		"pypi_index", upstreamURLs(cfg.pypiUpstreams),
+		"raw", upstreamURLs(cfg.rawUpstreams),
+		"raw_max_age", cfg.RawMaxAge.String(),
 	)
 
-	cache := provider.NewCache(*pathPtr, *repoPtr)
-	cache.Start(*workersPtr)
+	// running lists the caches being served, by mount path, for reloads.
+	type running struct {
+		path  string
+		cache *provider.Cache
+	}
+	var caches []running
 
 	metrics.Register(prometheus.DefaultRegisterer)
 
 	artifactMux := http.NewServeMux()
-	artifactMux.HandleFunc("/", cache.HandleArtifactRequest)
-
 	maintenanceMux := http.NewServeMux()
+	for _, m := range cfg.mounts {
+		// Mounts other than the top-level Maven cache keep their artifacts
+		// in a dot-directory of the storage, which the Maven cache never
+		// serves.
+		var mainRepo string
+		if len(m.upstreams) > 0 {
+			mainRepo = m.upstreams[0].URL
+		}
+		cache := provider.NewCache(filepath.Join(cfg.Path, m.sub), mainRepo)
+		storage, err := newStorage(cfg.Storage, s3Config, m.sub)
+		if err != nil {
+			slog.Error("invalid storage configuration", "error", err)
+			os.Exit(2)
+		}
+		if storage != nil {
+			cache.SetStorage(storage)
+		}
+		if err := cache.SetPresignHits(cfg.PresignHits, cfg.NoRedirectAgents); err != nil {
+			slog.Error("invalid presign configuration", "error", err)
+			os.Exit(2)
+		}
+		cache.SetFormat(m.format)
+		cache.SetBaseURL(strings.TrimRight(cfg.PublicURL, "/") + m.path)
+		cache.SetNegativeCache(m.negativeTTL, cfg.NegativePersist)
+		if m.format == provider.FormatGo {
+			cache.SetSumDB(cfg.GoSumDB)
+		}
+		if err := cache.SetMaxSize(cfg.maxSize, cfg.EvictHigh, cfg.EvictLow); err != nil {
+			slog.Error("invalid eviction configuration", "error", err)
+			os.Exit(2)
+		}
+		if err := cache.Reconfigure(cfg.cacheSettings(m)); err != nil {
+			slog.Error("invalid configuration", "mount", m.path, "error", err)
+			os.Exit(2)
+		}
+		cache.Start(cfg.Workers)
+		caches = append(caches, running{path: m.path, cache: cache})
+		slog.Info("serving cache", "mount", m.path+"/", "format", m.format.String(), "repos", upstreamURLs(m.upstreams), "hosted", strings.Join(m.hosted, ","))
+
+		if m.path == "" {
+			artifactMux.HandleFunc("/", cache.HandleArtifactRequest)
+			maintenanceMux.Handle("/admin/", cache.AdminHandler())
+			continue
+		}
+		if _, ok := cfg.mount(""); ok && strings.HasPrefix(m.sub, ".mounts/") {
+			slog.Warn("mount hides the artifacts of the top-level Maven cache below its path", "mount", m.path+"/")
+		}
+		artifactMux.Handle(m.path+"/", http.StripPrefix(m.path, http.HandlerFunc(cache.HandleArtifactRequest)))
+		maintenanceMux.Handle("/admin/mounts"+m.path+"/", mountedAdmin(m.path, cache.AdminHandler()))
+	}
+
+	guard := access.NewGuard(cfg.access)
+
+	// reload re-reads the configuration and applies what can change to the
+	// running caches. In-flight downloads are left alone.
+	started := cfg.config
+	reload := func() {
+		next, err := loadConfig(os.Args[1:], io.Discard)
+		if err != nil {
+			slog.Error("configuration reload failed; keeping the running configuration", "error", err)
+			return
+		}
+		if keys := restartRequired(started, next.config); len(keys) > 0 {
+			slog.Warn("configuration changes take a restart", "keys", strings.Join(keys, ","))
+		}
+		// Every cache is checked before any changes, so that a bad mount
+		// leaves all of them as they were.
+		type change struct {
+			running
+			settings provider.Settings
+		}
+		var changes []change
+		for _, c := range caches {
+			m, ok := next.mount(c.path)
+			if !ok {
+				continue
+			}
+			s := next.cacheSettings(m)
+			if err := s.Validate(); err != nil {
+				slog.Error("configuration reload failed; keeping the running configuration", "mount", c.path, "error", err)
+				return
+			}
+			changes = append(changes, change{c, s})
+		}
+		for _, c := range changes {
+			if err := c.cache.Reconfigure(c.settings); err != nil {
+				slog.Error("failed to apply configuration", "mount", c.path, "error", err)
+			}
+		}
+		guard.Set(next.access)
+		if err := logging.Init(next.LogLevel, started.LogFormat); err != nil {
+			slog.Error("invalid logging configuration", "error", err)
+		}
+		slog.Info("configuration reloaded", "config", next.ConfigFile)
+	}
+
 	maintenanceMux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
 	maintenanceMux.Handle("/metrics", promhttp.Handler())
 
 	artifactServer := &http.Server{
-		Addr:              *addrPtr,
-		Handler:           artifactMux,
+		Addr:              cfg.Addr,
+		Handler:           guard.Handler(artifactMux),
 		ReadHeaderTimeout: 5 * time.Second,
 		IdleTimeout:       60 * time.Second,
 	}
+	if cfg.ClientCA != "" {
+		tlsConfig, err := clientCertConfig(cfg.ClientCA)
+		if err != nil {
+			slog.Error("invalid TLS configuration", "error", err)
+			os.Exit(2)
+		}
+		artifactServer.TLSConfig = tlsConfig
+	}
 	maintenanceServer := &http.Server{
-		Addr:              *maintenanceAddrPtr,
+		Addr:              cfg.MaintenanceAddr,
 		Handler:           maintenanceMux,
 		ReadHeaderTimeout: 5 * time.Second,
 		IdleTimeout:       60 * time.Second,
@@ -68,6 +210,8 @@ func main() {
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
+	go watchConfig(ctx, cfg.ConfigFile, reload)
+
 	go func() {
 		<-ctx.Done()
 		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
@@ -79,8 +223,14 @@ func main() {
 	errCh := make(chan error, 2)
 
 	go func() {
-		slog.Info("artifact server listening", "addr", artifactServer.Addr)
-		if err := artifactServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		slog.Info("artifact server listening", "addr", artifactServer.Addr, "tls", cfg.TLSCert != "")
+		var err error
+		if cfg.TLSCert != "" {
+			err = artifactServer.ListenAndServeTLS(cfg.TLSCert, cfg.TLSKey)
+		} else {
+			err = artifactServer.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			errCh <- err
 			return
 		}
@@ -104,3 +254,140 @@ func main() {
 		}
 	}
 }
+
+// newStorage returns the storage backend selected by --storage for the
+// subdirectory sub, or nil for the default filesystem storage under the
+// cache path. S3 credentials come from the standard AWS_* environment
+// variables.
+func newStorage(kind string, cfg provider.S3Config, sub string) (provider.Storage, error) {
+	switch strings.ToLower(strings.TrimSpace(kind)) {
+	case "", "fs":
+		return nil, nil
+	case "s3":
+		if cfg.AccessKey == "" || cfg.SecretKey == "" {
+			return nil, fmt.Errorf("s3 storage requires AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+		}
+		cfg.Prefix = path.Join(cfg.Prefix, sub)
+		return provider.NewS3Storage(cfg)
+	default:
+		return nil, fmt.Errorf("invalid storage %q (expected fs or s3)", kind)
+	}
+}
+
+// mountedAdmin serves the admin endpoints of the cache mounted at mountPath
+// below /admin/mounts<mountPath>/, e.g. /admin/mounts/maven-public/entries.
+func mountedAdmin(mountPath string, h http.Handler) http.Handler {
+	prefix := "/admin/mounts" + mountPath
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.Path = "/admin" + strings.TrimPrefix(r.URL.Path, prefix)
+		r2.URL.RawPath = ""
+		h.ServeHTTP(w, r2)
+	})
+}
+
+// clientCertConfig asks artifact clients for certificates and verifies them
+// against the CAs in caFile. Clients without one may still use other
+// credentials.
+func clientCertConfig(caFile string) (*tls.Config, error) {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("read client CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("read client CA %q: no certificates found", caFile)
+	}
+	return &tls.Config{ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven, MinVersion: tls.VersionTLS12}, nil
+}
+
+// upstreamURLs lists upstreams for logging. Their URLs no longer carry
+// credentials.
+func upstreamURLs(upstreams []provider.Upstream) string {
+	list := make([]string, len(upstreams))
+	for i, u := range upstreams {
+		list[i] = u.Name + "=" + u.URL
+	}
+	return strings.Join(list, ",")
+}
+
+// addRoutes attaches name=glob include and exclude patterns to the named upstreams.
+func addRoutes(upstreams []provider.Upstream, includes, excludes []string) error {
+	find := func(rule string) (*provider.Upstream, string, error) {
+		name, pattern, ok := strings.Cut(rule, "=")
+		if !ok || pattern == "" {
+			return nil, "", fmt.Errorf("invalid route %q (expected name=glob)", rule)
+		}
+		for i := range upstreams {
+			if upstreams[i].Name == name {
+				return &upstreams[i], pattern, nil
+			}
+		}
+		return nil, "", fmt.Errorf("route %q refers to unknown repository %q", rule, name)
+	}
+	for _, rule := range includes {
+		u, pattern, err := find(rule)
+		if err != nil {
+			return err
+		}
+		u.Include = append(u.Include, pattern)
+	}
+	for _, rule := range excludes {
+		u, pattern, err := find(rule)
+		if err != nil {
+			return err
+		}
+		u.Exclude = append(u.Exclude, pattern)
+	}
+	for _, u := range upstreams {
+		if err := u.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// configPollInterval is how often the config file is checked for changes.
+const configPollInterval = 5 * time.Second
+
+// watchConfig calls reload on SIGHUP and, when a config file is in use,
+// whenever it changes, until ctx is done. Reloads run one at a time.
+func watchConfig(ctx context.Context, configFile string, reload func()) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+	stamp := func() string {
+		info, err := os.Stat(configFile)
+		if err != nil {
+			return ""
+		}
+		return fmt.Sprintf("%d/%d", info.ModTime().UnixNano(), info.Size())
+	}
+	last := stamp()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			slog.Info("reloading configuration", "reason", "SIGHUP")
+			last = stamp()
+			reload()
+		case <-ticker.C:
+			if configFile == "" {
+				continue
+			}
+			if current := stamp(); current != last {
+				last = current
+				slog.Info("reloading configuration", "reason", "file changed")
+				reload()
+			}
+		}
+	}
+}
@@ -3,10 +3,24 @@ package main_test
 import (
 	"articache/internal/metrics"
 	"articache/internal/provider"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -15,6 +29,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestRedirect(t *testing.T) {
@@ -55,6 +70,963 @@ func TestRedirect(t *testing.T) {
 	}
 }
 
+func TestProxyMissMode(t *testing.T) {
+	repo := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/maven2/com.missing.lib.jar" {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write([]byte("artifact bytes"))
+	}))
+	defer repo.Close()
+
+	rootDir := t.TempDir()
+	cache := provider.NewCache(rootDir, repo.URL+"/maven2")
+	cache.SetMissMode(provider.MissModeProxy)
+	cache.Start(2)
+
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	cacheServer := httptest.NewServer(http.HandlerFunc(cache.HandleArtifactRequest))
+	defer cacheServer.Close()
+
+	response, err := client.Get(cacheServer.URL + "/com.voovoo.lib.jar")
+	assert.NoError(t, err)
+	body, err := io.ReadAll(response.Body)
+	response.Body.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "artifact bytes", string(body))
+	assert.FileExists(t, rootDir+"/com.voovoo.lib.jar")
+
+	response, err = client.Get(cacheServer.URL + "/com.missing.lib.jar")
+	assert.NoError(t, err)
+	response.Body.Close()
+	assert.Equal(t, http.StatusNotFound, response.StatusCode)
+	assert.NoFileExists(t, rootDir+"/com.missing.lib.jar")
+}
+
+func TestUpstreamFallback(t *testing.T) {
+	empty := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusNotFound)
+	}))
+	defer empty.Close()
+	full := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write([]byte("from fallback"))
+	}))
+	defer full.Close()
+
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	upstreams := []provider.Upstream{
+		{Name: "empty", URL: empty.URL + "/maven2"},
+		{Name: "full", URL: full.URL + "/maven2"},
+	}
+
+	t.Run("redirect", func(t *testing.T) {
+		rootDir := t.TempDir()
+		cache := provider.NewCache(rootDir, upstreams[0].URL)
+		cache.SetUpstreams(upstreams)
+		cache.Start(2)
+		cacheServer := httptest.NewServer(http.HandlerFunc(cache.HandleArtifactRequest))
+		defer cacheServer.Close()
+
+		response, err := client.Get(cacheServer.URL + "/com.voovoo.lib.jar")
+		assert.NoError(t, err)
+		response.Body.Close()
+		assert.Equal(t, http.StatusSeeOther, response.StatusCode)
+		assert.Equal(t, full.URL+"/maven2/com.voovoo.lib.jar", response.Header.Get("Location"))
+		assert.Eventually(t, func() bool {
+			_, err := os.Stat(rootDir + "/com.voovoo.lib.jar")
+			return err == nil
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("proxy", func(t *testing.T) {
+		rootDir := t.TempDir()
+		cache := provider.NewCache(rootDir, upstreams[0].URL)
+		cache.SetUpstreams(upstreams)
+		cache.SetMissMode(provider.MissModeProxy)
+		cache.Start(2)
+		cacheServer := httptest.NewServer(http.HandlerFunc(cache.HandleArtifactRequest))
+		defer cacheServer.Close()
+
+		response, err := client.Get(cacheServer.URL + "/com.voovoo.lib.jar")
+		assert.NoError(t, err)
+		body, _ := io.ReadAll(response.Body)
+		response.Body.Close()
+		assert.Equal(t, http.StatusOK, response.StatusCode)
+		assert.Equal(t, "from fallback", string(body))
+		assert.FileExists(t, rootDir+"/com.voovoo.lib.jar")
+	})
+}
+
+func TestUpstreamAuthentication(t *testing.T) {
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	serve := func(authorized func(r *http.Request) bool) http.HandlerFunc {
+		return func(rw http.ResponseWriter, r *http.Request) {
+			switch {
+			case !authorized(r):
+				rw.WriteHeader(http.StatusUnauthorized)
+			case path.Ext(r.URL.Path) != ".jar":
+				rw.WriteHeader(http.StatusNotFound)
+			default:
+				_, _ = rw.Write([]byte("private artifact"))
+			}
+		}
+	}
+	get := func(t *testing.T, upstream provider.Upstream) {
+		t.Helper()
+		rootDir := t.TempDir()
+		cache := provider.NewCache(rootDir, upstream.URL)
+		cache.SetUpstreams([]provider.Upstream{upstream})
+		cache.Start(2)
+		cacheServer := httptest.NewServer(http.HandlerFunc(cache.HandleArtifactRequest))
+		defer cacheServer.Close()
+
+		// Clients cannot be redirected to an upstream that wants credentials,
+		// so misses are proxied.
+		response, err := client.Get(cacheServer.URL + "/com/ourcompany/lib/1.0/lib-1.0.jar")
+		require.NoError(t, err)
+		body, _ := io.ReadAll(response.Body)
+		response.Body.Close()
+		assert.Equal(t, http.StatusOK, response.StatusCode)
+		assert.Equal(t, "private artifact", string(body))
+		assert.FileExists(t, rootDir+"/com/ourcompany/lib/1.0/lib-1.0.jar")
+	}
+
+	t.Run("basic", func(t *testing.T) {
+		repo := httptest.NewServer(serve(func(r *http.Request) bool {
+			user, password, ok := r.BasicAuth()
+			return ok && user == "deployer" && password == "s3cret"
+		}))
+		defer repo.Close()
+		upstream, err := provider.ParseUpstream("nexus=http://deployer:s3cret@" + strings.TrimPrefix(repo.URL, "http://") + "/maven2")
+		require.NoError(t, err)
+		assert.Equal(t, repo.URL+"/maven2", upstream.URL)
+		assert.NotContains(t, fmt.Sprintf("%v %+v %#v", upstream, upstream, upstream), "s3cret")
+		get(t, upstream)
+	})
+
+	t.Run("bearer", func(t *testing.T) {
+		repo := httptest.NewServer(serve(func(r *http.Request) bool {
+			return r.Header.Get("Authorization") == "Bearer ghp_token"
+		}))
+		defer repo.Close()
+		get(t, provider.Upstream{Name: "github", URL: repo.URL + "/maven2", Credentials: &provider.Credentials{Token: "ghp_token"}})
+	})
+
+	t.Run("client certificate", func(t *testing.T) {
+		repo := httptest.NewUnstartedServer(serve(func(r *http.Request) bool {
+			return len(r.TLS.PeerCertificates) > 0
+		}))
+		repo.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+		repo.StartTLS()
+		defer repo.Close()
+		roots := x509.NewCertPool()
+		roots.AddCert(repo.Certificate())
+		get(t, provider.Upstream{Name: "mtls", URL: repo.URL + "/maven2", Credentials: &provider.Credentials{
+			TLS: &tls.Config{Certificates: repo.TLS.Certificates, RootCAs: roots},
+		}})
+	})
+}
+
+func TestHostedUpload(t *testing.T) {
+	var upstreamRequests atomic.Int32
+	repo := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		upstreamRequests.Add(1)
+		_, _ = rw.Write([]byte("from upstream"))
+	}))
+	defer repo.Close()
+
+	rootDir := t.TempDir()
+	cache := provider.NewCache(rootDir, repo.URL+"/maven2")
+	cache.SetHosted([]string{"/com/ourcompany"})
+	cache.SetMissMode(provider.MissModeProxy)
+	cache.Start(2)
+	cacheServer := httptest.NewServer(http.HandlerFunc(cache.HandleArtifactRequest))
+	defer cacheServer.Close()
+
+	put := func(name, body string) int {
+		req, err := http.NewRequest(http.MethodPut, cacheServer.URL+name, strings.NewReader(body))
+		require.NoError(t, err)
+		response, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		response.Body.Close()
+		return response.StatusCode
+	}
+	get := func(name string) (int, string) {
+		response, err := http.Get(cacheServer.URL + name)
+		require.NoError(t, err)
+		body, _ := io.ReadAll(response.Body)
+		response.Body.Close()
+		return response.StatusCode, string(body)
+	}
+	sha1Hex := func(s string) string {
+		sum := sha1.Sum([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+
+	release := "/com/ourcompany/lib/1.0/lib-1.0.jar"
+	assert.Equal(t, http.StatusCreated, put(release, "release bytes"))
+	assert.Equal(t, http.StatusCreated, put(release+".sha1", sha1Hex("release bytes")))
+	status, body := get(release)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "release bytes", body)
+	status, body = get(release + ".sha1")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, sha1Hex("release bytes"), body)
+
+	assert.Equal(t, http.StatusConflict, put(release, "other bytes"), "releases cannot be redeployed")
+	assert.Equal(t, http.StatusConflict, put(release+".sha1", sha1Hex("other bytes")))
+
+	snapshot := "/com/ourcompany/lib/1.1-SNAPSHOT/lib-1.1-SNAPSHOT.jar"
+	assert.Equal(t, http.StatusCreated, put(snapshot, "first build"))
+	assert.Equal(t, http.StatusCreated, put(snapshot, "second build"), "snapshots can be redeployed")
+	assert.Equal(t, http.StatusCreated, put("/com/ourcompany/lib/maven-metadata.xml", "<metadata/>"))
+	assert.Equal(t, http.StatusCreated, put("/com/ourcompany/lib/maven-metadata.xml", "<metadata></metadata>"))
+
+	broken := "/com/ourcompany/lib/1.2-SNAPSHOT/lib-1.2-SNAPSHOT.jar"
+	assert.Equal(t, http.StatusCreated, put(broken, "truncated"))
+	assert.Equal(t, http.StatusBadRequest, put(broken+".sha1", sha1Hex("complete")))
+	assert.NoFileExists(t, rootDir+broken, "snapshots failing verification are removed")
+	assert.Equal(t, http.StatusBadRequest, put(release+".sha256", "0000"))
+	assert.FileExists(t, rootDir+release, "a mismatching checksum never removes a confirmed release")
+	assert.NoFileExists(t, rootDir+release+".sha256")
+
+	corrupt := "/com/ourcompany/lib/1.3/lib-1.3.jar"
+	assert.Equal(t, http.StatusCreated, put(corrupt, "corrupt"))
+	assert.Equal(t, http.StatusCreated, put(corrupt, "release bytes"), "unconfirmed releases can be redeployed")
+	assert.Equal(t, http.StatusBadRequest, put(corrupt+".sha1", sha1Hex("other bytes")))
+	assert.NoFileExists(t, rootDir+corrupt, "unconfirmed releases failing verification are removed")
+	assert.Equal(t, http.StatusCreated, put(corrupt, "release bytes"))
+	assert.Equal(t, http.StatusCreated, put(corrupt+".sha1", sha1Hex("release bytes")))
+	assert.Equal(t, http.StatusConflict, put(corrupt, "other bytes"), "confirmed releases cannot be redeployed")
+
+	concurrent := "/com/ourcompany/lib/2.0/lib-2.0.jar"
+	var mu sync.Mutex
+	var created []string
+	var wg sync.WaitGroup
+	for i := range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			build := fmt.Sprintf("build %d", i)
+			if put(concurrent, build) == http.StatusCreated {
+				mu.Lock()
+				created = append(created, build)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	_, body = get(concurrent)
+	assert.Contains(t, created, body, "concurrent deploys of a release store one of them whole")
+	assert.Equal(t, http.StatusConflict, put("/com/ourcompany/lib/3.0/lib-3.0.jar.sha1", sha1Hex("x")), "checksums need their artifact")
+
+	status, _ = get("/com/ourcompany/lib/4.0/lib-4.0.jar")
+	assert.Equal(t, http.StatusNotFound, status, "hosted misses are not resolved upstream")
+	assert.Zero(t, upstreamRequests.Load())
+
+	assert.Equal(t, http.StatusMethodNotAllowed, put("/org/apache/lib/1.0/lib-1.0.jar", "proxied"))
+}
+
+func TestRequestSemantics(t *testing.T) {
+	content := strings.Repeat("0123456789", 100)
+	var gets atomic.Int32
+	repo := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/maven2/com/voovoo/lib.jar" {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method == http.MethodGet {
+			gets.Add(1)
+		}
+		rw.Header().Set("ETag", `"upstream"`)
+		http.ServeContent(rw, r, "lib.jar", time.Time{}, strings.NewReader(content))
+	}))
+	defer repo.Close()
+
+	rootDir := t.TempDir()
+	cache := provider.NewCache(rootDir, repo.URL+"/maven2")
+	cache.Start(2)
+	cacheServer := httptest.NewServer(http.HandlerFunc(cache.HandleArtifactRequest))
+	defer cacheServer.Close()
+
+	do := func(method, path string, header map[string]string) (*http.Response, string) {
+		req, err := http.NewRequest(method, cacheServer.URL+path, nil)
+		require.NoError(t, err)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		response, err := http.DefaultTransport.RoundTrip(req)
+		require.NoError(t, err)
+		defer response.Body.Close()
+		body, _ := io.ReadAll(response.Body)
+		return response, string(body)
+	}
+
+	response, _ := do(http.MethodHead, "/com/voovoo/lib.jar", nil)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "1000", response.Header.Get("Content-Length"))
+	response, _ = do(http.MethodHead, "/com/voovoo/missing.jar", nil)
+	assert.Equal(t, http.StatusNotFound, response.StatusCode)
+	time.Sleep(100 * time.Millisecond)
+	assert.Zero(t, gets.Load(), "HEAD misses download nothing")
+	assert.NoFileExists(t, rootDir+"/com/voovoo/lib.jar")
+
+	response, _ = do(http.MethodPost, "/com/voovoo/lib.jar", nil)
+	assert.Equal(t, http.StatusMethodNotAllowed, response.StatusCode)
+	assert.Equal(t, "GET, HEAD", response.Header.Get("Allow"))
+
+	cache.SetMissMode(provider.MissModeProxy)
+	response, body := do(http.MethodGet, "/com/voovoo/lib.jar", map[string]string{"Range": "bytes=10-19"})
+	assert.Equal(t, http.StatusPartialContent, response.StatusCode)
+	assert.Equal(t, "bytes 10-19/1000", response.Header.Get("Content-Range"))
+	assert.Equal(t, "0123456789", body)
+	assert.Empty(t, response.Header.Get("ETag"), "upstream entity tags are not passed on")
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(rootDir + "/com/voovoo/lib.jar")
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond, "the whole artifact is downloaded in the background")
+
+	sum := sha256.Sum256([]byte(content))
+	etag := `"` + hex.EncodeToString(sum[:]) + `"`
+	response, body = do(http.MethodGet, "/com/voovoo/lib.jar", map[string]string{"Range": "bytes=990-"})
+	assert.Equal(t, http.StatusPartialContent, response.StatusCode)
+	assert.Equal(t, "0123456789", body)
+	assert.Equal(t, etag, response.Header.Get("ETag"))
+	response, _ = do(http.MethodGet, "/com/voovoo/lib.jar", map[string]string{"If-None-Match": etag})
+	assert.Equal(t, http.StatusNotModified, response.StatusCode)
+	response, body = do(http.MethodHead, "/com/voovoo/lib.jar", nil)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, etag, response.Header.Get("ETag"))
+	assert.Empty(t, body)
+}
+
+func TestNegativeCache(t *testing.T) {
+	var requests atomic.Int32
+	repo := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		rw.WriteHeader(http.StatusNotFound)
+	}))
+	defer repo.Close()
+
+	cache := provider.NewCache(t.TempDir(), repo.URL+"/maven2")
+	cache.SetMissMode(provider.MissModeProxy)
+	cache.SetNegativeCache(time.Minute, false)
+	cache.Start(2)
+	cacheServer := httptest.NewServer(http.HandlerFunc(cache.HandleArtifactRequest))
+	defer cacheServer.Close()
+
+	for i := 0; i < 3; i++ {
+		response, err := http.Get(cacheServer.URL + "/com.voovoo.lib-sources.jar")
+		assert.NoError(t, err)
+		response.Body.Close()
+		assert.Equal(t, http.StatusNotFound, response.StatusCode)
+	}
+	assert.Equal(t, int32(1), requests.Load())
+}
+
+func TestMetadataRevalidation(t *testing.T) {
+	var version, requests atomic.Int32
+	var hang, fail atomic.Bool
+	release := make(chan struct{})
+	version.Store(1)
+	repo := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if hang.Load() {
+			<-release
+		}
+		if fail.Load() {
+			rw.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		etag := fmt.Sprintf(`"v%d"`, version.Load())
+		if r.Header.Get("If-None-Match") == etag {
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+		rw.Header().Set("ETag", etag)
+		_, _ = rw.Write([]byte(etag))
+	}))
+
+	cache := provider.NewCache(t.TempDir(), repo.URL+"/maven2")
+	cache.SetMissMode(provider.MissModeProxy)
+	cache.SetPolicy(provider.Policy{MetadataMaxAge: time.Nanosecond})
+	cache.SetRetryPolicy(provider.RetryPolicy{Attempts: 1})
+	cache.Start(2)
+	cacheServer := httptest.NewServer(http.HandlerFunc(cache.HandleArtifactRequest))
+	defer cacheServer.Close()
+
+	get := func() string {
+		response, err := http.Get(cacheServer.URL + "/com/voovoo/lib/maven-metadata.xml")
+		assert.NoError(t, err)
+		defer response.Body.Close()
+		body, _ := io.ReadAll(response.Body)
+		return string(body)
+	}
+
+	assert.Equal(t, `"v1"`, get())
+	assert.Equal(t, `"v1"`, get())
+	version.Store(2)
+	assert.Equal(t, `"v2"`, get())
+
+	hang.Store(true)
+	start := time.Now()
+	assert.Equal(t, `"v2"`, get(), "stale copy is served while upstream hangs")
+	assert.Less(t, time.Since(start), 5*time.Second)
+	hang.Store(false)
+	close(release)
+	assert.Eventually(t, func() bool {
+		sent := requests.Load()
+		get()
+		return requests.Load() > sent
+	}, 5*time.Second, 10*time.Millisecond, "hits revalidate again once the hanging revalidation is done")
+
+	fail.Store(true)
+	sent := requests.Load()
+	assert.Equal(t, `"v2"`, get())
+	assert.Greater(t, requests.Load(), sent)
+	sent = requests.Load()
+	assert.Equal(t, `"v2"`, get())
+	assert.Equal(t, sent, requests.Load(), "a failed revalidation is not retried on every hit")
+
+	repo.Close()
+	assert.Equal(t, `"v2"`, get(), "stale copy is served while upstream is unreachable")
+}
+
+func TestMetadataMerge(t *testing.T) {
+	metadata := func(latest, lastUpdated string, versions ...string) string {
+		return `<?xml version="1.0" encoding="UTF-8"?><metadata><groupId>com.voovoo</groupId><artifactId>lib</artifactId><versioning>` +
+			`<latest>` + latest + `</latest><release>` + latest + `</release><versions><version>` + strings.Join(versions, `</version><version>`) +
+			`</version></versions><lastUpdated>` + lastUpdated + `</lastUpdated></versioning></metadata>`
+	}
+	var central atomic.Value
+	central.Store(metadata("1.1", "20240101000000", "1.0", "1.1"))
+	upstream := func(doc func() string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/maven2/com/voovoo/lib/maven-metadata.xml" {
+				rw.WriteHeader(http.StatusNotFound)
+				return
+			}
+			_, _ = rw.Write([]byte(doc()))
+		}))
+	}
+	first := upstream(func() string { return central.Load().(string) })
+	defer first.Close()
+	second := upstream(func() string { return metadata("2.0", "20240201000000", "1.0", "2.0") })
+
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	cache := provider.NewCache(t.TempDir(), first.URL+"/maven2")
+	cache.SetUpstreams([]provider.Upstream{{Name: "first", URL: first.URL + "/maven2"}, {Name: "second", URL: second.URL + "/maven2"}})
+	cache.SetPolicy(provider.Policy{MetadataMaxAge: time.Nanosecond})
+	cache.Start(2)
+	cacheServer := httptest.NewServer(http.HandlerFunc(cache.HandleArtifactRequest))
+	defer cacheServer.Close()
+
+	get := func(name string) string {
+		response, err := client.Get(cacheServer.URL + "/com/voovoo/lib/" + name)
+		require.NoError(t, err)
+		defer response.Body.Close()
+		require.Equal(t, http.StatusOK, response.StatusCode, "merged metadata is served, not redirected")
+		body, _ := io.ReadAll(response.Body)
+		return string(body)
+	}
+	assertChecksums := func(doc string) {
+		sha := sha1.Sum([]byte(doc))
+		assert.Equal(t, hex.EncodeToString(sha[:]), get("maven-metadata.xml.sha1"))
+		sum := md5.Sum([]byte(doc))
+		assert.Equal(t, hex.EncodeToString(sum[:]), get("maven-metadata.xml.md5"))
+	}
+
+	doc := get("maven-metadata.xml")
+	assert.Contains(t, doc, "<version>1.0</version>\n      <version>1.1</version>\n      <version>2.0</version>")
+	assert.Contains(t, doc, "<latest>2.0</latest>")
+	assert.Contains(t, doc, "<release>2.0</release>")
+	assert.Contains(t, doc, "<lastUpdated>20240201000000</lastUpdated>")
+	assertChecksums(doc)
+
+	central.Store(metadata("2.1", "20240301000000", "1.0", "1.1", "2.1"))
+	second.Close()
+	doc = get("maven-metadata.xml")
+	assert.Contains(t, doc, "<version>2.0</version>", "an unreachable upstream contributes its last copy")
+	assert.Contains(t, doc, "<version>2.1</version>")
+	assert.Contains(t, doc, "<latest>2.1</latest>")
+	assert.Contains(t, doc, "<lastUpdated>20240301000000</lastUpdated>")
+	assertChecksums(doc)
+}
+
+func TestRawFormat(t *testing.T) {
+	var version, downloads atomic.Int32
+	version.Store(1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/distributions/gradle-8.5-bin.zip":
+			rw.Header().Set("Cache-Control", "public, max-age=86400")
+			downloads.Add(1)
+			_, _ = rw.Write([]byte("gradle"))
+		case "/nightly/latest.tar.gz":
+			etag := fmt.Sprintf(`"v%d"`, version.Load())
+			rw.Header().Set("Cache-Control", "no-cache")
+			rw.Header().Set("ETag", etag)
+			if r.Header.Get("If-None-Match") == etag {
+				rw.WriteHeader(http.StatusNotModified)
+				return
+			}
+			_, _ = rw.Write([]byte(etag))
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer upstream.Close()
+
+	cache := provider.NewCache(t.TempDir(), upstream.URL)
+	cache.SetFormat(provider.FormatRaw)
+	cache.SetMissMode(provider.MissModeProxy)
+	cache.Start(2)
+	cacheServer := httptest.NewServer(http.HandlerFunc(cache.HandleArtifactRequest))
+	defer cacheServer.Close()
+
+	get := func(p string) string {
+		response, err := http.Get(cacheServer.URL + p)
+		assert.NoError(t, err)
+		defer response.Body.Close()
+		body, _ := io.ReadAll(response.Body)
+		return string(body)
+	}
+
+	assert.Equal(t, "gradle", get("/distributions/gradle-8.5-bin.zip"))
+	assert.Equal(t, "gradle", get("/distributions/gradle-8.5-bin.zip"))
+	assert.Equal(t, int32(1), downloads.Load(), "a fresh copy is served without asking upstream")
+
+	assert.Equal(t, `"v1"`, get("/nightly/latest.tar.gz"))
+	assert.Equal(t, `"v1"`, get("/nightly/latest.tar.gz"))
+	version.Store(2)
+	assert.Equal(t, `"v2"`, get("/nightly/latest.tar.gz"), "no-cache copies are revalidated on every hit")
+}
+
+func TestChecksumVerification(t *testing.T) {
+	content := []byte("artifact bytes")
+	sum := sha1.Sum(content)
+	repo := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/maven2/com.good.lib.jar.sha1":
+			_, _ = rw.Write([]byte(hex.EncodeToString(sum[:]) + "  com.good.lib.jar"))
+		case "/maven2/com.corrupt.lib.jar.sha1":
+			_, _ = rw.Write([]byte("0000000000000000000000000000000000000000"))
+		case "/maven2/com.good.lib.jar", "/maven2/com.corrupt.lib.jar":
+			_, _ = rw.Write(content)
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer repo.Close()
+
+	rootDir := t.TempDir()
+	cache := provider.NewCache(rootDir, repo.URL+"/maven2")
+	cache.SetMissMode(provider.MissModeProxy)
+	cache.SetChecksumPolicy(provider.ChecksumStrict)
+	cache.Start(2)
+	cacheServer := httptest.NewServer(http.HandlerFunc(cache.HandleArtifactRequest))
+	defer cacheServer.Close()
+
+	response, err := http.Get(cacheServer.URL + "/com.good.lib.jar")
+	assert.NoError(t, err)
+	body, err := io.ReadAll(response.Body)
+	response.Body.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, content, body)
+	assert.FileExists(t, rootDir+"/com.good.lib.jar")
+
+	response, err = http.Get(cacheServer.URL + "/com.corrupt.lib.jar")
+	if err == nil {
+		_, err = io.ReadAll(response.Body)
+		response.Body.Close()
+	}
+	assert.Error(t, err, "a corrupt artifact must not look like a complete transfer")
+	assert.NoFileExists(t, rootDir+"/com.corrupt.lib.jar")
+}
+
+func TestConcurrentMissesShareOneFetch(t *testing.T) {
+	var requests atomic.Int32
+	repo := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		time.Sleep(200 * time.Millisecond)
+		_, _ = rw.Write([]byte("artifact bytes"))
+	}))
+	defer repo.Close()
+
+	cache := provider.NewCache(t.TempDir(), repo.URL+"/maven2")
+	cache.SetMissMode(provider.MissModeProxy)
+	cache.SetChecksumPolicy(provider.ChecksumOff)
+	cache.Start(2)
+	cacheServer := httptest.NewServer(http.HandlerFunc(cache.HandleArtifactRequest))
+	defer cacheServer.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			response, err := http.Get(cacheServer.URL + "/com.voovoo.lib.jar")
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer response.Body.Close()
+			body, _ := io.ReadAll(response.Body)
+			assert.Equal(t, http.StatusOK, response.StatusCode)
+			assert.Equal(t, "artifact bytes", string(body))
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), requests.Load())
+}
+
+func TestUpstreamFailures(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(metrics.UpstreamCircuitState)
+
+	var requests, flaky atomic.Int32
+	repo := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.URL.Path == "/maven2/com/voovoo/flaky.jar" && flaky.Add(1) > 1 {
+			_, _ = rw.Write([]byte("artifact bytes"))
+			return
+		}
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer repo.Close()
+
+	cache := provider.NewCache(t.TempDir(), repo.URL+"/maven2")
+	cache.SetUpstreams([]provider.Upstream{{Name: "central", URL: repo.URL + "/maven2"}})
+	cache.SetMissMode(provider.MissModeProxy)
+	cache.SetChecksumPolicy(provider.ChecksumOff)
+	cache.SetRetryPolicy(provider.RetryPolicy{Attempts: 3, Backoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond})
+	cache.SetBreakerPolicy(provider.BreakerPolicy{Threshold: 2, Cooldown: time.Hour})
+	cache.Start(2)
+	cacheServer := httptest.NewServer(http.HandlerFunc(cache.HandleArtifactRequest))
+	defer cacheServer.Close()
+	admin := httptest.NewServer(cache.AdminHandler())
+	defer admin.Close()
+
+	get := func(url string) (int, string) {
+		response, err := http.Get(url)
+		require.NoError(t, err)
+		defer response.Body.Close()
+		body, _ := io.ReadAll(response.Body)
+		return response.StatusCode, string(body)
+	}
+
+	status, body := get(cacheServer.URL + "/com/voovoo/flaky.jar")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "artifact bytes", body)
+	assert.Equal(t, int32(2), flaky.Load(), "a 503 is retried")
+
+	requests.Store(0)
+	status, _ = get(cacheServer.URL + "/com/voovoo/down.jar")
+	assert.Equal(t, http.StatusBadGateway, status)
+	assert.Equal(t, int32(3), requests.Load(), "retries stop after the configured attempts")
+	status, _ = get(cacheServer.URL + "/com/voovoo/down.jar")
+	assert.Equal(t, http.StatusBadGateway, status)
+
+	requests.Store(0)
+	status, _ = get(cacheServer.URL + "/com/voovoo/other.jar")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Zero(t, requests.Load(), "an open circuit sends nothing upstream")
+
+	_, body = get(admin.URL + "/admin/upstreams")
+	var out struct {
+		Upstreams []struct {
+			Name     string `json:"name"`
+			State    string `json:"state"`
+			Failures int    `json:"failures"`
+		} `json:"upstreams"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(body), &out))
+	require.Len(t, out.Upstreams, 1)
+	assert.Equal(t, "central", out.Upstreams[0].Name)
+	assert.Equal(t, "open", out.Upstreams[0].State)
+	assert.Equal(t, 2, out.Upstreams[0].Failures)
+
+	metricsServer := httptest.NewServer(promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	defer metricsServer.Close()
+	_, body = get(metricsServer.URL)
+	assert.Contains(t, body, `articache_upstream_circuit_state{upstream="central",url="`+repo.URL+`/maven2"} 2`)
+}
+
+func TestNPMRegistry(t *testing.T) {
+	tarball := []byte("package tarball")
+	integrity := sha512.Sum512(tarball)
+	var registry *httptest.Server
+	registry = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		switch r.URL.EscapedPath() {
+		case "/@acme%2fwidgets":
+			rw.Header().Set("Content-Type", "application/json")
+			_, _ = fmt.Fprintf(rw, `{"name":"@acme/widgets","versions":{`+
+				`"1.0.0":{"dist":{"tarball":"%[1]s/@acme/widgets/-/widgets-1.0.0.tgz","integrity":"sha512-%[2]s"}},`+
+				`"1.0.1":{"dist":{"tarball":"%[1]s/@acme/widgets/-/widgets-1.0.1.tgz","integrity":"sha512-%[3]s"}}}}`,
+				registry.URL, base64.StdEncoding.EncodeToString(integrity[:]), base64.StdEncoding.EncodeToString(make([]byte, 64)))
+		case "/@acme/widgets/-/widgets-1.0.0.tgz", "/@acme/widgets/-/widgets-1.0.1.tgz", "/@acme/widgets/-/widgets-2.0.0.tgz":
+			_, _ = rw.Write(tarball)
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer registry.Close()
+
+	cache := provider.NewCache(t.TempDir(), registry.URL)
+	cache.SetFormat(provider.FormatNPM)
+	cache.SetBaseURL("/npm")
+	cache.SetMissMode(provider.MissModeProxy)
+	cache.Start(2)
+	mux := http.NewServeMux()
+	mux.Handle("/npm/", http.StripPrefix("/npm", http.HandlerFunc(cache.HandleArtifactRequest)))
+	cacheServer := httptest.NewServer(mux)
+	defer cacheServer.Close()
+
+	response, err := http.Get(cacheServer.URL + "/npm/@acme%2fwidgets")
+	assert.NoError(t, err)
+	var packument struct {
+		Versions map[string]struct {
+			Dist struct{ Tarball string }
+		}
+	}
+	assert.NoError(t, json.NewDecoder(response.Body).Decode(&packument))
+	response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	tarballURL := packument.Versions["1.0.0"].Dist.Tarball
+	assert.Equal(t, cacheServer.URL+"/npm/@acme/widgets/-/widgets-1.0.0.tgz", tarballURL)
+
+	response, err = http.Get(tarballURL)
+	assert.NoError(t, err)
+	body, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, tarball, body)
+
+	// The registry publishes an integrity that the 1.0.1 tarball does not match.
+	response, err = http.Get(packument.Versions["1.0.1"].Dist.Tarball)
+	if err == nil {
+		_, err = io.ReadAll(response.Body)
+		response.Body.Close()
+	}
+	assert.Error(t, err, "a tarball failing its integrity check must not look like a complete transfer")
+
+	response, err = http.Get(cacheServer.URL + "/npm/-/v1/search?text=widgets")
+	assert.NoError(t, err)
+	response.Body.Close()
+	assert.Equal(t, http.StatusNotFound, response.StatusCode)
+
+	// npm ci fetches tarballs from the lockfile without asking for packuments.
+	rootDir := t.TempDir()
+	lockfileCache := provider.NewCache(rootDir, registry.URL)
+	lockfileCache.SetFormat(provider.FormatNPM)
+	lockfileCache.SetMissMode(provider.MissModeProxy)
+	lockfileCache.Start(2)
+	lockfileServer := httptest.NewServer(http.HandlerFunc(lockfileCache.HandleArtifactRequest))
+	defer lockfileServer.Close()
+
+	response, err = http.Get(lockfileServer.URL + "/@acme/widgets/-/widgets-1.0.1.tgz")
+	if err == nil {
+		_, err = io.ReadAll(response.Body)
+		response.Body.Close()
+	}
+	assert.Error(t, err, "the packument is fetched to verify a tarball requested first")
+
+	response, err = http.Get(lockfileServer.URL + "/@acme/widgets/-/widgets-2.0.0.tgz")
+	assert.NoError(t, err)
+	response.Body.Close()
+	assert.Equal(t, http.StatusBadGateway, response.StatusCode, "tarballs no packument lists are refused")
+	assert.NoFileExists(t, rootDir+"/@acme/widgets/-/widgets-2.0.0.tgz")
+
+	response, err = http.Get(lockfileServer.URL + "/@acme/widgets/-/widgets-1.0.0.tgz")
+	assert.NoError(t, err)
+	body, _ = io.ReadAll(response.Body)
+	response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, tarball, body)
+}
+
+func TestGoModuleProxy(t *testing.T) {
+	goMod := []byte("module github.com/Acme/lib\n\ngo 1.22\n")
+	modSum := sha256.Sum256(goMod)
+	summary := sha256.Sum256([]byte(hex.EncodeToString(modSum[:]) + "  go.mod\n"))
+	modHash := "h1:" + base64.StdEncoding.EncodeToString(summary[:])
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/github.com/!acme/lib/@v/list":
+			_, _ = rw.Write([]byte("v1.0.0\n"))
+		case "/github.com/!acme/lib/@v/v1.0.0.mod":
+			_, _ = rw.Write(goMod)
+		case "/github.com/!acme/lib/@v/v1.0.0.zip":
+			_, _ = rw.Write([]byte("not the published zip"))
+		default:
+			http.Error(rw, "gone", http.StatusGone)
+		}
+	}))
+	defer upstream.Close()
+	sumdb := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/lookup/github.com/!acme/lib@v1.0.0" {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = fmt.Fprintf(rw, "42\ngithub.com/Acme/lib v1.0.0 h1:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=\ngithub.com/Acme/lib v1.0.0/go.mod %s\n\ngo.sum database tree\n", modHash)
+	}))
+	defer sumdb.Close()
+
+	rootDir := t.TempDir()
+	cache := provider.NewCache(rootDir, upstream.URL)
+	cache.SetFormat(provider.FormatGo)
+	cache.SetSumDB(sumdb.URL)
+	cache.SetMissMode(provider.MissModeProxy)
+	cache.Start(2)
+	cacheServer := httptest.NewServer(http.HandlerFunc(cache.HandleArtifactRequest))
+	defer cacheServer.Close()
+
+	get := func(p string) (int, string, error) {
+		response, err := http.Get(cacheServer.URL + p)
+		if err != nil {
+			return 0, "", err
+		}
+		defer response.Body.Close()
+		body, err := io.ReadAll(response.Body)
+		return response.StatusCode, string(body), err
+	}
+
+	status, body, err := get("/github.com/!acme/lib/@v/list")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "v1.0.0\n", body)
+
+	status, body, err = get("/github.com/!acme/lib/@v/v1.0.0.mod")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, string(goMod), body)
+	assert.FileExists(t, rootDir+"/github.com/!acme/lib/@v/v1.0.0.mod")
+
+	_, _, err = get("/github.com/!acme/lib/@v/v1.0.0.zip")
+	assert.Error(t, err, "a zip not matching the checksum database must not look like a complete transfer")
+	assert.NoFileExists(t, rootDir+"/github.com/!acme/lib/@v/v1.0.0.zip")
+
+	status, _, err = get("/github.com/!acme/lib/@v/v2.0.0.info")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, status, "410 from upstream means not found")
+
+	status, _, err = get("/github.com/Acme/lib/@v/list")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, status, "upper-case letters must be escaped")
+}
+
+func TestPyPIIndex(t *testing.T) {
+	wheel := []byte("wheel contents")
+	wheelSum := sha256.Sum256(wheel)
+	index := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/simple/demo-pkg/":
+			rw.Header().Set("Content-Type", "text/html")
+			_, _ = fmt.Fprintf(rw, `<html><body>`+
+				`<a href="../../files/demo_pkg-1.0-py3-none-any.whl#sha256=%s" data-requires-python="&gt;=3.9">demo_pkg-1.0-py3-none-any.whl</a>`+
+				`<a href="../../files/demo_pkg-1.1-py3-none-any.whl#sha256=%s">demo_pkg-1.1-py3-none-any.whl</a>`+
+				`</body></html>`, hex.EncodeToString(wheelSum[:]), hex.EncodeToString(make([]byte, 32)))
+		case "/files/demo_pkg-1.0-py3-none-any.whl", "/files/demo_pkg-1.1-py3-none-any.whl", "/packages/demo-pkg/demo_pkg-2.0-py3-none-any.whl":
+			_, _ = rw.Write(wheel)
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer index.Close()
+
+	rootDir := t.TempDir()
+	cache := provider.NewCache(rootDir, index.URL)
+	cache.SetFormat(provider.FormatPyPI)
+	cache.SetBaseURL("/pypi")
+	cache.SetMissMode(provider.MissModeProxy)
+	cache.Start(2)
+	mux := http.NewServeMux()
+	mux.Handle("/pypi/", http.StripPrefix("/pypi", http.HandlerFunc(cache.HandleArtifactRequest)))
+	cacheServer := httptest.NewServer(mux)
+	defer cacheServer.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, cacheServer.URL+"/pypi/simple/Demo.Pkg/", nil)
+	req.Header.Set("Accept", "application/vnd.pypi.simple.v1+json")
+	response, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	var project struct {
+		Name  string
+		Files []struct {
+			Filename string
+			URL      string
+			Hashes   map[string]string
+		}
+	}
+	assert.NoError(t, json.NewDecoder(response.Body).Decode(&project))
+	response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "application/vnd.pypi.simple.v1+json", response.Header.Get("Content-Type"))
+	assert.Equal(t, cacheServer.URL+"/pypi/simple/demo-pkg/", response.Request.URL.String(), "project names are normalized")
+	assert.Equal(t, "demo-pkg", project.Name)
+	if assert.Len(t, project.Files, 2) {
+		assert.Equal(t, cacheServer.URL+"/pypi/packages/demo-pkg/demo_pkg-1.0-py3-none-any.whl", project.Files[0].URL)
+		assert.Equal(t, hex.EncodeToString(wheelSum[:]), project.Files[0].Hashes["sha256"])
+	}
+
+	response, err = http.Get(cacheServer.URL + "/pypi/simple/demo-pkg/")
+	assert.NoError(t, err)
+	page, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+	assert.Equal(t, "text/html", response.Header.Get("Content-Type"))
+	assert.Contains(t, string(page), `href="`+cacheServer.URL+`/pypi/packages/demo-pkg/demo_pkg-1.0-py3-none-any.whl#sha256=`+hex.EncodeToString(wheelSum[:])+`"`)
+	assert.Contains(t, string(page), `data-requires-python="&gt;=3.9"`)
+
+	response, err = http.Get(cacheServer.URL + "/pypi/packages/demo-pkg/demo_pkg-1.0-py3-none-any.whl")
+	assert.NoError(t, err)
+	body, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, wheel, body)
+
+	response, err = http.Get(cacheServer.URL + "/pypi/packages/demo-pkg/demo_pkg-1.1-py3-none-any.whl")
+	if err == nil {
+		_, err = io.ReadAll(response.Body)
+		response.Body.Close()
+	}
+	assert.Error(t, err, "a file not matching its published sha256 must not look like a complete transfer")
+
+	response, err = http.Get(cacheServer.URL + "/pypi/packages/demo-pkg/demo_pkg-2.0-py3-none-any.whl")
+	assert.NoError(t, err)
+	response.Body.Close()
+	assert.Equal(t, http.StatusBadGateway, response.StatusCode, "files the project page does not list are refused")
+	assert.NoFileExists(t, rootDir+"/packages/demo-pkg/demo_pkg-2.0-py3-none-any.whl")
+
+	response, err = http.Get(cacheServer.URL + "/pypi/simple/missing/")
+	assert.NoError(t, err)
+	response.Body.Close()
+	assert.Equal(t, http.StatusNotFound, response.StatusCode)
+
+	// pip install from a lockfile asks for files without the project page.
+	redirectCache := provider.NewCache(t.TempDir(), index.URL)
+	redirectCache.SetFormat(provider.FormatPyPI)
+	redirectCache.Start(2)
+	redirectServer := httptest.NewServer(http.HandlerFunc(redirectCache.HandleArtifactRequest))
+	defer redirectServer.Close()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	response, err = client.Get(redirectServer.URL + "/packages/demo-pkg/demo_pkg-1.0-py3-none-any.whl")
+	assert.NoError(t, err)
+	response.Body.Close()
+	assert.Equal(t, http.StatusSeeOther, response.StatusCode)
+	assert.Equal(t, index.URL+"/files/demo_pkg-1.0-py3-none-any.whl", response.Header.Get("Location"), "clients are sent where the project page links")
+}
+
 func TestMetricsEndpoint(t *testing.T) {
 	rootDir := t.TempDir()
 